@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
 	"unicode"
 )
 
@@ -53,7 +54,9 @@ func DecodeBencode(bencData string) (interface{}, error) {
 }
 
 func decodeNextBencToken(bencData string) (interface{}, uint, error) {
-	if unicode.IsDigit(rune(bencData[0])) {
+	if len(bencData) == 0 {
+		return "", 0, fmt.Errorf("Unexpected end of bencoded data")
+	} else if unicode.IsDigit(rune(bencData[0])) {
 		return decodeBencString(bencData)
 	} else if rune(bencData[0]) == 'i' {
 		return decodeBencInt(bencData)
@@ -72,7 +75,7 @@ func decodeNextBencToken(bencData string) (interface{}, uint, error) {
 func decodeBencDict(bencData string) (map[string]interface{}, uint, error) {
 	result := make(map[string]interface{})
 	i := 1
-	for bencData[i] != 'e' && i < len(bencData) {
+	for i < len(bencData) && bencData[i] != 'e' {
 		key, skipIndex, err := decodeBencString(bencData[i:])
 		if err != nil {
 			return map[string]interface{}{}, 0, err
@@ -103,7 +106,7 @@ func decodeBencDict(bencData string) (map[string]interface{}, uint, error) {
 func decodeBencList(bencData string) ([]interface{}, uint, error) {
 	result := make([]interface{}, 0)
 	i := uint(1)
-	for bencData[i] != 'e' {
+	for i < uint(len(bencData)) && bencData[i] != 'e' {
 		token, nextIndex, err := decodeNextBencToken(bencData[i:])
 		if err != nil {
 			return []interface{}{}, 0, err
@@ -111,7 +114,7 @@ func decodeBencList(bencData string) ([]interface{}, uint, error) {
 		i += nextIndex
 		result = append(result, token)
 	}
-	if bencData[i] != 'e' {
+	if i >= uint(len(bencData)) {
 		err := fmt.Errorf("Bencoded list '%s' missing trailing 'e'", bencData)
 		return []interface{}{}, 0, err
 	}
@@ -124,13 +127,9 @@ func decodeBencList(bencData string) ([]interface{}, uint, error) {
 // - "5:hello" -> "hello"
 // - "10:hello12345" -> "hello12345"
 func decodeBencString(bencData string) (string, uint, error) {
-	var colonIndex int
-
-	for i, c := range bencData {
-		if c == ':' {
-			colonIndex = i
-			break
-		}
+	colonIndex := strings.IndexByte(bencData, ':')
+	if colonIndex < 0 {
+		return "", 0, fmt.Errorf("Bencoded string '%s' missing ':'", bencData)
 	}
 
 	lengthStr := bencData[:colonIndex]
@@ -138,6 +137,9 @@ func decodeBencString(bencData string) (string, uint, error) {
 	if err != nil {
 		return "", 0, err
 	}
+	if length < 0 || length > len(bencData)-colonIndex-1 {
+		return "", 0, fmt.Errorf("Bencoded string length %d out of bounds", length)
+	}
 	nextIndex := uint(colonIndex + 1 + length)
 
 	return bencData[colonIndex+1 : nextIndex], nextIndex, nil
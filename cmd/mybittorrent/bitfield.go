@@ -2,8 +2,32 @@ package main
 
 type Bitfield []byte
 
+func NewBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
 func (bitfield Bitfield) HasPiece(pieceIndex int) bool {
+	if pieceIndex < 0 || pieceIndex/8 >= len(bitfield) {
+		return false
+	}
 	targetByte := uint8(bitfield[pieceIndex/8])
 	indexAsByteBitfield := uint8(1 << (7 - (pieceIndex % 8)))
 	return (targetByte & indexAsByteBitfield) > 0
 }
+
+func (bitfield Bitfield) SetPiece(pieceIndex int) {
+	if pieceIndex < 0 || pieceIndex/8 >= len(bitfield) {
+		return
+	}
+	bitfield[pieceIndex/8] |= uint8(1 << (7 - (pieceIndex % 8)))
+}
+
+// Complete reports whether bitfield has all of the first numPieces pieces.
+func (bitfield Bitfield) Complete(numPieces int) bool {
+	for i := 0; i < numPieces; i++ {
+		if !bitfield.HasPiece(i) {
+			return false
+		}
+	}
+	return true
+}
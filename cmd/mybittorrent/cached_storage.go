@@ -0,0 +1,304 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const DefaultCacheSize = 64 * 1024 * 1024
+
+// FsyncPolicy is when a CachedStorage syncs the storage under it to disk.
+type FsyncPolicy int
+
+const (
+	FsyncNever FsyncPolicy = iota
+	FsyncOnClose
+	// After each piece is flushed, so a crash loses no completed piece.
+	FsyncEveryPiece
+)
+
+func ParseFsyncPolicy(policy string) (FsyncPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "never":
+		return FsyncNever, nil
+	case "close":
+		return FsyncOnClose, nil
+	case "piece":
+		return FsyncEveryPiece, nil
+	}
+	return 0, fmt.Errorf("Unknown fsync policy %q. Expected never, close or piece.", policy)
+}
+
+// syncer is implemented by storage that can flush its writes to disk.
+type syncer interface {
+	Sync() error
+}
+
+// cachedPiece is a piece held by a CachedStorage.
+type cachedPiece struct {
+	index int
+	data  []byte
+	dirty bool // not written to the storage yet
+	// Dirty pieces are flushed once complete. Clean ones are in the LRU list.
+	complete bool
+	lru      *list.Element
+}
+
+// CachedStorage is a bounded cache in front of another Storage. Writes to a
+// piece are gathered in memory and written as a whole piece by a background
+// goroutine, once the piece is complete. Pieces read, e.g. to serve peers, are
+// kept around so they needn't be read again for the next block.
+type CachedStorage struct {
+	storage Storage
+	info    *torrentInfo
+	size    int // most bytes to hold
+	fsync   FsyncPolicy
+
+	mu     sync.Mutex
+	cond   *sync.Cond // signalled when a piece is queued or flushed, or on close
+	pieces map[int]*cachedPiece
+	used   int
+	lru    *list.List // clean pieces, most recently used first
+	queue  []*cachedPiece
+	// Pieces written while the cache was full. They bypass the cache, so that
+	// their data on disk isn't overwritten by a partial copy.
+	direct  map[int]bool
+	err     error // the first failed flush, returned from then on
+	closing bool
+	done    chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewCachedStorage puts a cache of size bytes in front of storage, and starts
+// its flusher.
+func NewCachedStorage(storage Storage, info *torrentInfo, size int, fsync FsyncPolicy) *CachedStorage {
+	c := &CachedStorage{
+		storage: storage,
+		info:    info,
+		size:    size,
+		fsync:   fsync,
+		pieces:  make(map[int]*cachedPiece),
+		lru:     list.New(),
+		direct:  make(map[int]bool),
+		done:    make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.flusher()
+	return c
+}
+
+func (c *CachedStorage) ReadAt(b []byte, pieceIndex int, offset int) (int, error) {
+	c.mu.Lock()
+	if piece, ok := c.pieces[pieceIndex]; ok {
+		if piece.lru != nil {
+			c.lru.MoveToFront(piece.lru)
+		}
+		n := copyPieceRange(b, piece.data, offset)
+		c.mu.Unlock()
+		if n < len(b) {
+			return n, fmt.Errorf("Piece %d has no data at %d+%d", pieceIndex, offset, len(b))
+		}
+		return n, nil
+	}
+	direct := c.direct[pieceIndex]
+	c.mu.Unlock()
+
+	// Reading the whole piece fails if part of it isn't stored, e.g. when it
+	// overlaps a skipped file. Then only the range asked for is read.
+	if !direct {
+		data := make([]byte, c.info.pieceSize(pieceIndex))
+		if _, err := c.storage.ReadAt(data, pieceIndex, 0); err == nil {
+			c.mu.Lock()
+			if _, ok := c.pieces[pieceIndex]; !ok {
+				piece := &cachedPiece{index: pieceIndex, data: data}
+				c.pieces[pieceIndex] = piece
+				piece.lru = c.lru.PushFront(piece)
+				c.used += len(data)
+				c.evict(0)
+			}
+			c.mu.Unlock()
+			return copyPieceRange(b, data, offset), nil
+		}
+	}
+	return c.storage.ReadAt(b, pieceIndex, offset)
+}
+
+func copyPieceRange(b []byte, data []byte, offset int) int {
+	if offset < 0 || offset >= len(data) {
+		return 0
+	}
+	return copy(b, data[offset:])
+}
+
+// WriteAt keeps the data until the piece is marked complete. If the cache is
+// full of pieces that aren't complete, it writes to the storage directly.
+func (c *CachedStorage) WriteAt(b []byte, pieceIndex int, offset int) (int, error) {
+	pieceSize := c.info.pieceSize(pieceIndex)
+	if offset < 0 || offset+len(b) > pieceSize {
+		return 0, fmt.Errorf("Write of %d+%d is outside piece %d", offset, len(b), pieceIndex)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	piece, ok := c.pieces[pieceIndex]
+	if ok && !piece.dirty {
+		// It's in the read cache, so it's being written again.
+		c.dropClean(piece)
+		ok = false
+	} else if ok && piece.complete {
+		return 0, fmt.Errorf("Piece %d is complete and can't be written", pieceIndex)
+	}
+	if !ok && !c.direct[pieceIndex] {
+		// Wait for complete pieces to be flushed, to make room.
+		c.evict(pieceSize)
+		for c.err == nil && c.used+pieceSize > c.size && len(c.queue) > 0 {
+			c.cond.Wait()
+			c.evict(pieceSize)
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.used+pieceSize <= c.size {
+			piece = &cachedPiece{index: pieceIndex, data: make([]byte, pieceSize), dirty: true}
+			c.pieces[pieceIndex] = piece
+			c.used += pieceSize
+			ok = true
+		} else {
+			c.direct[pieceIndex] = true
+		}
+	}
+	if !ok {
+		c.mu.Unlock()
+		n, err := c.storage.WriteAt(b, pieceIndex, offset)
+		c.mu.Lock()
+		return n, err
+	}
+	return copy(piece.data[offset:], b), nil
+}
+
+// MarkComplete queues the piece to be written. The storage under the cache is
+// marked complete once the piece is written to it.
+func (c *CachedStorage) MarkComplete(pieceIndex int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	piece, ok := c.pieces[pieceIndex]
+	if !ok || !piece.dirty {
+		delete(c.direct, pieceIndex)
+		c.mu.Unlock()
+		err := c.storage.MarkComplete(pieceIndex)
+		c.mu.Lock()
+		return err
+	}
+	if !piece.complete {
+		piece.complete = true
+		c.queue = append(c.queue, piece)
+		c.cond.Broadcast()
+	}
+	return nil
+}
+
+func (c *CachedStorage) flusher() {
+	defer close(c.done)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for len(c.queue) == 0 && !c.closing {
+			c.cond.Wait()
+		}
+		if len(c.queue) == 0 {
+			return
+		}
+		piece := c.queue[0]
+		c.queue = c.queue[1:]
+
+		c.mu.Unlock()
+		err := c.flush(piece)
+		c.mu.Lock()
+		if err != nil {
+			if c.err == nil {
+				c.err = err
+			}
+		} else {
+			piece.dirty = false
+			piece.lru = c.lru.PushFront(piece)
+			c.evict(0)
+		}
+		c.cond.Broadcast()
+	}
+}
+
+func (c *CachedStorage) flush(piece *cachedPiece) error {
+	if _, err := c.storage.WriteAt(piece.data, piece.index, 0); err != nil {
+		return err
+	}
+	if err := c.storage.MarkComplete(piece.index); err != nil {
+		return err
+	}
+	if c.fsync == FsyncEveryPiece {
+		return c.sync()
+	}
+	return nil
+}
+
+func (c *CachedStorage) sync() error {
+	if s, ok := c.storage.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// evict drops the least recently used clean pieces, until there's room for
+// extra more bytes.
+func (c *CachedStorage) evict(extra int) {
+	for c.used+extra > c.size && c.lru.Len() > 0 {
+		c.dropClean(c.lru.Back().Value.(*cachedPiece))
+	}
+}
+
+func (c *CachedStorage) dropClean(piece *cachedPiece) {
+	c.lru.Remove(piece.lru)
+	delete(c.pieces, piece.index)
+	c.used -= len(piece.data)
+}
+
+// Close flushes the complete pieces, writes the data of incomplete ones, and
+// closes the storage under the cache. Closing again just returns the first
+// result.
+func (c *CachedStorage) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.close()
+	})
+	return c.closeErr
+}
+
+func (c *CachedStorage) close() error {
+	c.mu.Lock()
+	c.closing = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	<-c.done
+
+	err := c.err
+	for _, piece := range c.pieces {
+		if piece.dirty && !piece.complete && err == nil {
+			_, err = c.storage.WriteAt(piece.data, piece.index, 0)
+		}
+	}
+	if err == nil && c.fsync != FsyncNever {
+		err = c.sync()
+	}
+	if closeErr := c.storage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
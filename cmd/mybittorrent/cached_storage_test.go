@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+// countingStorage is a MemoryStorage that counts the calls made to it.
+type countingStorage struct {
+	*MemoryStorage
+
+	mu        sync.Mutex
+	reads     int
+	writes    int
+	completes int
+	syncs     int
+	closes    int
+}
+
+func newCountingStorage(info *torrentInfo) *countingStorage {
+	return &countingStorage{MemoryStorage: NewMemoryStorage(info)}
+}
+
+func (s *countingStorage) ReadAt(b []byte, pieceIndex int, offset int) (int, error) {
+	s.mu.Lock()
+	s.reads++
+	s.mu.Unlock()
+	return s.MemoryStorage.ReadAt(b, pieceIndex, offset)
+}
+
+func (s *countingStorage) WriteAt(b []byte, pieceIndex int, offset int) (int, error) {
+	s.mu.Lock()
+	s.writes++
+	s.mu.Unlock()
+	return s.MemoryStorage.WriteAt(b, pieceIndex, offset)
+}
+
+func (s *countingStorage) MarkComplete(pieceIndex int) error {
+	s.mu.Lock()
+	s.completes++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *countingStorage) Sync() error {
+	s.mu.Lock()
+	s.syncs++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *countingStorage) Close() error {
+	s.mu.Lock()
+	s.closes++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *countingStorage) counts() (reads, writes, completes, syncs, closes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads, s.writes, s.completes, s.syncs, s.closes
+}
+
+const testCachePieceLength = 1024
+
+func newTestCacheInfo(numPieces int) *torrentInfo {
+	return &torrentInfo{
+		pieceLength: testCachePieceLength,
+		length:      numPieces * testCachePieceLength,
+		pieces:      make([]string, numPieces),
+	}
+}
+
+// writeTestPiece writes a piece filled with its index, in four blocks.
+func writeTestPiece(t *testing.T, storage Storage, pieceIndex int) {
+	t.Helper()
+	block := bytes.Repeat([]byte{byte(pieceIndex)}, testCachePieceLength/4)
+	for offset := 0; offset < testCachePieceLength; offset += len(block) {
+		if _, err := storage.WriteAt(block, pieceIndex, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.MarkComplete(pieceIndex); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachedStorageCoalescesWrites(t *testing.T) {
+	info := newTestCacheInfo(3)
+	under := newCountingStorage(info)
+	cache := NewCachedStorage(under, info, 2*testCachePieceLength, FsyncNever)
+	for i := 0; i < 3; i++ {
+		writeTestPiece(t, cache, i)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each piece is written whole, once.
+	_, writes, completes, _, closes := under.counts()
+	if writes != 3 || completes != 3 || closes != 1 {
+		t.Fatalf("Got %d writes, %d completes and %d closes, expected 3, 3 and 1", writes, completes, closes)
+	}
+	for i := 0; i < 3; i++ {
+		piece := make([]byte, testCachePieceLength)
+		if _, err := under.MemoryStorage.ReadAt(piece, i, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(piece, bytes.Repeat([]byte{byte(i)}, testCachePieceLength)) {
+			t.Fatalf("Piece %d doesn't match", i)
+		}
+	}
+}
+
+func TestCachedStorageReadCache(t *testing.T) {
+	info := newTestCacheInfo(3)
+	under := newCountingStorage(info)
+	for i := 0; i < 3; i++ {
+		writeTestPiece(t, under, i)
+	}
+	cache := NewCachedStorage(under, info, 2*testCachePieceLength, FsyncNever)
+	defer cache.Close()
+
+	read := func(pieceIndex int) {
+		t.Helper()
+		block := make([]byte, 16)
+		if _, err := cache.ReadAt(block, pieceIndex, 100); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(block, bytes.Repeat([]byte{byte(pieceIndex)}, 16)) {
+			t.Fatalf("Block of piece %d doesn't match", pieceIndex)
+		}
+	}
+	expectReads := func(expected int) {
+		t.Helper()
+		if reads, _, _, _, _ := under.counts(); reads != expected {
+			t.Fatalf("Got %d reads from the storage, expected %d", reads, expected)
+		}
+	}
+
+	read(0)
+	read(0)
+	expectReads(1)
+	read(1)
+	read(0)
+	expectReads(2)
+	// The cache holds two pieces, so piece 2 evicts piece 1, the least
+	// recently used.
+	read(2)
+	read(0)
+	expectReads(3)
+	read(1)
+	expectReads(4)
+}
+
+func TestCachedStorageFsync(t *testing.T) {
+	tests := []struct {
+		policy FsyncPolicy
+		syncs  int
+	}{
+		{FsyncNever, 0},
+		{FsyncOnClose, 1},
+		{FsyncEveryPiece, 3 + 1},
+	}
+	for _, tt := range tests {
+		info := newTestCacheInfo(3)
+		under := newCountingStorage(info)
+		cache := NewCachedStorage(under, info, 4*testCachePieceLength, tt.policy)
+		for i := 0; i < 3; i++ {
+			writeTestPiece(t, cache, i)
+		}
+		if err := cache.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Closing again does nothing.
+		if err := cache.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, syncs, closes := under.counts()
+		if syncs != tt.syncs || closes != 1 {
+			t.Errorf("Policy %d: got %d syncs and %d closes, expected %d syncs and 1 close", tt.policy, syncs, closes, tt.syncs)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUploadSlots = 4
+
+	rechokeInterval = 10 * time.Second
+	// The optimistic unchoke rotates every optimisticRounds rechokes, i.e. every 30s.
+	optimisticRounds = 3
+	// Peers that connected recently are this many times more likely to get
+	// the optimistic unchoke, so they get a chance to start trading.
+	newPeerWeight = 3
+	newPeerAge    = time.Minute
+)
+
+// Choker implements the tit-for-tat choking algorithm. Every rechokeInterval
+// it unchokes the uploadSlots interested peers that give us the best download
+// rate (or that we upload to fastest, when seeding) and chokes the rest,
+// except for one optimistically unchoked peer which rotates every 30s.
+type Choker struct {
+	mu          sync.Mutex
+	peers       []*PeerConn
+	uploadSlots int
+	seeding     func() bool
+
+	optimistic *PeerConn
+	round      int
+	lastRound  time.Time
+	// Byte counters of each peer at the previous rechoke.
+	lastDownloaded map[*PeerConn]int64
+	lastUploaded   map[*PeerConn]int64
+}
+
+func NewChoker(uploadSlots int, seeding func() bool) *Choker {
+	return &Choker{
+		uploadSlots:    uploadSlots,
+		seeding:        seeding,
+		lastRound:      time.Now(),
+		lastDownloaded: make(map[*PeerConn]int64),
+		lastUploaded:   make(map[*PeerConn]int64),
+	}
+}
+
+func (c *Choker) AddPeer(peerConn *PeerConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers = append(c.peers, peerConn)
+	c.lastDownloaded[peerConn] = peerConn.Downloaded()
+	c.lastUploaded[peerConn] = peerConn.Uploaded()
+}
+
+func (c *Choker) RemovePeer(peerConn *PeerConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.peers {
+		if p == peerConn {
+			c.peers = append(c.peers[:i], c.peers[i+1:]...)
+			break
+		}
+	}
+	delete(c.lastDownloaded, peerConn)
+	delete(c.lastUploaded, peerConn)
+	if c.optimistic == peerConn {
+		c.optimistic = nil
+	}
+}
+
+// PeerBecameInterested unchokes a newly interested peer straight away if an
+// upload slot is free, instead of making it wait for the next rechoke.
+func (c *Choker) PeerBecameInterested(peerConn *PeerConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	unchoked := 0
+	for _, p := range c.peers {
+		if !p.AmChoking() && p.PeerInterested() {
+			unchoked++
+		}
+	}
+	if unchoked < c.uploadSlots {
+		if err := peerConn.SetChoking(false); err != nil {
+			fmt.Printf("Failed to update choke state of peer %s: %v\n", peerConn.Conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// Run rechokes every rechokeInterval until ctx is done.
+func (c *Choker) Run(ctx context.Context) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+
+	c.Rechoke()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Rechoke()
+		}
+	}
+}
+
+func (c *Choker) Rechoke() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(c.lastRound).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	c.lastRound = now
+
+	seeding := c.seeding()
+	rates := make(map[*PeerConn]float64, len(c.peers))
+	for _, p := range c.peers {
+		downloaded, uploaded := p.Downloaded(), p.Uploaded()
+		if seeding {
+			rates[p] = float64(uploaded-c.lastUploaded[p]) / elapsed
+		} else {
+			rates[p] = float64(downloaded-c.lastDownloaded[p]) / elapsed
+		}
+		c.lastDownloaded[p] = downloaded
+		c.lastUploaded[p] = uploaded
+	}
+
+	interested := make([]*PeerConn, 0, len(c.peers))
+	for _, p := range c.peers {
+		if p.PeerInterested() {
+			interested = append(interested, p)
+		}
+	}
+	sort.SliceStable(interested, func(i, j int) bool {
+		return rates[interested[i]] > rates[interested[j]]
+	})
+
+	unchoke := make(map[*PeerConn]bool, c.uploadSlots+1)
+	for i := 0; i < len(interested) && i < c.uploadSlots; i++ {
+		unchoke[interested[i]] = true
+	}
+
+	if c.round%optimisticRounds == 0 || c.optimistic == nil || !c.optimistic.PeerInterested() {
+		c.optimistic = c.pickOptimistic(interested, unchoke, now)
+	}
+	c.round++
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+
+	for _, p := range c.peers {
+		if err := p.SetChoking(!unchoke[p]); err != nil {
+			fmt.Printf("Failed to update choke state of peer %s: %v\n", p.Conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// pickOptimistic picks a random interested peer that isn't already unchoked.
+func (c *Choker) pickOptimistic(interested []*PeerConn, unchoked map[*PeerConn]bool, now time.Time) *PeerConn {
+	candidates := make([]*PeerConn, 0, len(interested))
+	for _, p := range interested {
+		if unchoked[p] {
+			continue
+		}
+		candidates = append(candidates, p)
+		if now.Sub(p.ConnectedAt) < newPeerAge {
+			for i := 1; i < newPeerWeight; i++ {
+				candidates = append(candidates, p)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return candidates[rand.Intn(len(candidates))]
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestChokerRanksPeers(t *testing.T) {
+	tests := []struct {
+		name    string
+		seeding bool
+		// The peers unchoked for their rate, besides the optimistic one.
+		expected []int
+	}{
+		{"downloading", false, []int{0, 1}},
+		{"seeding", true, []int{5, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seeding := tt.seeding
+			c := NewChoker(2, func() bool { return seeding })
+			var peers []*PeerConn
+			for i := 0; i < 6; i++ {
+				conn, other := net.Pipe()
+				defer conn.Close()
+				defer other.Close()
+				p := NewPeerConn(conn, Peer{}, &Handshake{})
+				p.peerInterested = true
+				c.AddPeer(p)
+				// Peer i sends us the least and gets the most from us as i
+				// grows.
+				atomic.StoreInt64(&p.downloaded, int64(5-i)*1000)
+				atomic.StoreInt64(&p.uploaded, int64(i)*1000)
+				peers = append(peers, p)
+			}
+
+			c.Rechoke()
+			for _, i := range tt.expected {
+				if peers[i].AmChoking() {
+					t.Errorf("Peer %d is choked, expected it unchoked", i)
+				}
+			}
+			unchoked := 0
+			for _, p := range peers {
+				if !p.AmChoking() {
+					unchoked++
+				}
+			}
+			// Two for their rates, and one optimistically.
+			if unchoked != 3 {
+				t.Errorf("Unchoked %d peers, expected 3", unchoked)
+			}
+		})
+	}
+}
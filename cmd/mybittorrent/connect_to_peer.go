@@ -1,48 +1,163 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"time"
 )
 
-type PeerConn struct {
-	Conn       net.Conn
-	Interested bool
-	Choked     bool
+const (
+	dialTimeout      = 10 * time.Second
+	handshakeTimeout = 20 * time.Second
+)
+
+// dialPeer connects over uTP if we have a UTP socket, and over TCP if that
+// fails.
+func dialPeer(ctx context.Context, addr string) (net.Conn, error) {
+	if UTP != nil {
+		utpCtx, cancel := context.WithTimeout(ctx, utpConnectTimeout)
+		conn, err := UTP.DialContext(utpCtx, addr)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	return dialer.DialContext(ctx, "tcp", addr)
 }
 
-func (peerConn *PeerConn) Close() {
-	peerConn.Conn.Close()
+// watchConn bounds the I/O on conn to timeout, and interrupts it early if ctx
+// is cancelled. The returned func ends the watch and clears the deadline.
+func watchConn(ctx context.Context, conn net.Conn, timeout time.Duration) func() {
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+		conn.SetDeadline(time.Time{})
+	}
 }
 
-func NewPeerConn(conn net.Conn) PeerConn {
-	return PeerConn{conn, false, true}
+// ConnectToPeer connects to peer and completes the handshake, encrypting the
+// connection according to the Encryption mode.
+func ConnectToPeer(ctx context.Context, peer Peer, infoHash []byte, extension bool) (*PeerConn, error) {
+	encrypt := Encryption != EncryptionDisable
+	peerConn, err := connectToPeer(ctx, peer, infoHash, extension, encrypt)
+	if err != nil && encrypt && Encryption == EncryptionPrefer && errors.Is(err, errEncryptionHandshake) {
+		// The peer may not support encryption, so try again in plaintext.
+		peerConn, err = connectToPeer(ctx, peer, infoHash, extension, false)
+	}
+	return peerConn, err
 }
 
-func ConnectToPeer(peer Peer, infoHash []byte, extension bool) (PeerConn, Bitfield, error) {
-	peerIpPort := fmt.Sprintf("%s:%d", peer.Ip, peer.Port)
+func connectToPeer(ctx context.Context, peer Peer, infoHash []byte, extension bool, encrypt bool) (*PeerConn, error) {
+	conn, err := dialPeer(ctx, peer.Addr())
+	if err != nil {
+		return nil, err
+	}
 
-	conn, err := net.Dial("tcp", peerIpPort)
+	if encrypt {
+		stopWatching := watchConn(ctx, conn, handshakeTimeout)
+		encryptedConn, err := mseInitiate(conn, infoHash, mseProvide())
+		stopWatching()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = encryptedConn
+	}
+
+	peerHandshake, err := handshake(ctx, conn, infoHash, extension)
 	if err != nil {
-		return PeerConn{}, nil, err
+		conn.Close()
+		return nil, err
 	}
 
-	_, err = handshake(conn, infoHash, extension)
+	peerConn := NewPeerConn(conn, peer, peerHandshake)
+	peerConn.Outgoing = true
+	return peerConn, nil
+}
+
+// AcceptPeer completes the handshake of an incoming connection, which must be
+// for one of infoHashes: a torrent's, or both of a hybrid torrent's. The
+// connection may start with the encryption handshake.
+func AcceptPeer(ctx context.Context, conn net.Conn, infoHashes [][]byte, extension bool) (*PeerConn, error) {
+	stopWatching := watchConn(ctx, conn, handshakeTimeout)
+	defer stopWatching()
+
+	br := bufio.NewReader(conn)
+	start, err := br.Peek(len(plaintextHandshakePrefix))
+	if err != nil {
+		return nil, err
+	}
+	peerAddr := conn.RemoteAddr()
+	if bytes.Equal(start, plaintextHandshakePrefix) {
+		if Encryption == EncryptionRequire {
+			return nil, fmt.Errorf("Rejecting plaintext connection, encryption is required")
+		}
+		conn = &mseConn{conn, br, conn}
+	} else {
+		if Encryption == EncryptionDisable {
+			return nil, fmt.Errorf("Rejecting encrypted connection, encryption is disabled")
+		}
+		var infoHash []byte
+		conn, infoHash, err = mseRespond(conn, br, infoHashes, mseProvide())
+		if err != nil {
+			return nil, err
+		}
+		infoHashes = [][]byte{infoHash}
+	}
+
+	peerHandshake, err := readHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	infoHash := infoHashes[0]
+	for _, candidate := range infoHashes {
+		if bytes.Equal(peerHandshake.InfoHash, candidate) {
+			infoHash = candidate
+		}
+	}
+	err = peerHandshake.validate(infoHash)
 	if err != nil {
-		return PeerConn{}, nil, err
+		return nil, err
 	}
 
-	fmt.Printf("Waiting for 'bitfield' msg from the peer...\n")
-	peerMsg, err := readPeerMessage(conn)
+	err = writeHandshake(conn, infoHash, extension)
 	if err != nil {
-		return PeerConn{}, nil, err
+		return nil, err
 	}
-	fmt.Printf("Read peer msg with id %d, payload: %x\n", peerMsg.id, peerMsg.payload)
 
-	var bitfield Bitfield
-	if peerMsg.id == pmidBitfield {
-		bitfield = peerMsg.payload
+	peer := Peer{}
+	switch addr := peerAddr.(type) {
+	case *net.TCPAddr:
+		peer = Peer{Ip: addr.IP, Port: uint(addr.Port)}
+	case *net.UDPAddr:
+		peer = Peer{Ip: addr.IP, Port: uint(addr.Port)}
 	}
 
-	return NewPeerConn(conn), bitfield, nil
+	return NewPeerConn(conn, peer, peerHandshake), nil
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minCreatePieceLength = 16 * 1024
+	maxCreatePieceLength = 16 * 1024 * 1024
+	// Without a piece length given, it's picked for about this many pieces.
+	targetCreatePieces = 1500
+)
+
+// CreateOptions configures the torrents made by CreateTorrent.
+type CreateOptions struct {
+	PieceLength int // 0 picks one from the size of the content
+	// The first tracker is the announce URL. With more, they all go in
+	// announce-list, one per tier.
+	Trackers []string
+	WebSeeds []string
+	Private  bool
+}
+
+type createFile struct {
+	osPath string
+	path   []string // in the torrent
+	length int
+}
+
+// CreateTorrent makes a v1 torrent of a file, or of the regular files in a
+// directory, and returns it bencoded.
+func CreateTorrent(root string, opts CreateOptions) (string, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(filepath.Clean(root))
+
+	var files []createFile
+	if stat.IsDir() {
+		files, err = listCreateFiles(root)
+		if err != nil {
+			return "", err
+		}
+		if len(files) == 0 {
+			return "", fmt.Errorf("No files in %s", root)
+		}
+	} else {
+		files = []createFile{{root, []string{name}, int(stat.Size())}}
+	}
+
+	totalLength := 0
+	for _, file := range files {
+		totalLength += file.length
+	}
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = minCreatePieceLength
+		for pieceLength < maxCreatePieceLength && totalLength/pieceLength > targetCreatePieces {
+			pieceLength *= 2
+		}
+	}
+	if pieceLength < minCreatePieceLength || pieceLength&(pieceLength-1) != 0 {
+		return "", fmt.Errorf("Invalid piece length %d. Expected a power of two of at least 16 KiB.", pieceLength)
+	}
+
+	pieces, err := hashCreateFiles(files, pieceLength)
+	if err != nil {
+		return "", err
+	}
+
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceLength,
+		"pieces":       pieces,
+	}
+	if stat.IsDir() {
+		fileList := make([]interface{}, len(files))
+		for i, file := range files {
+			path := make([]interface{}, len(file.path))
+			for j, elem := range file.path {
+				path[j] = elem
+			}
+			fileList[i] = map[string]interface{}{"length": file.length, "path": path}
+		}
+		info["files"] = fileList
+	} else {
+		info["length"] = totalLength
+	}
+	if opts.Private {
+		info["private"] = 1
+	}
+
+	torr := map[string]interface{}{
+		"info":          info,
+		"created by":    "bittorrent-go 0.0.1",
+		"creation date": int(time.Now().Unix()),
+	}
+	if len(opts.Trackers) > 0 {
+		torr["announce"] = opts.Trackers[0]
+	}
+	if len(opts.Trackers) > 1 {
+		tiers := make([]interface{}, len(opts.Trackers))
+		for i, tracker := range opts.Trackers {
+			tiers[i] = []interface{}{tracker}
+		}
+		torr["announce-list"] = tiers
+	}
+	if len(opts.WebSeeds) > 0 {
+		urlList := make([]interface{}, len(opts.WebSeeds))
+		for i, seedURL := range opts.WebSeeds {
+			urlList[i] = seedURL
+		}
+		torr["url-list"] = urlList
+	}
+
+	return Bencode(torr), nil
+}
+
+// listCreateFiles lists the regular files under root, sorted by path.
+func listCreateFiles(root string) ([]createFile, error) {
+	var files []createFile
+	err := filepath.WalkDir(root, func(osPath string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, osPath)
+		if err != nil {
+			return err
+		}
+		files = append(files, createFile{osPath, strings.Split(filepath.ToSlash(rel), "/"), int(info.Size())})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return strings.Join(files[i].path, "/") < strings.Join(files[j].path, "/")
+	})
+	return files, nil
+}
+
+// hashCreateFiles returns the concatenated SHA-1 hashes of the pieces of the
+// files, laid out one after the other. The files are read in order, and the
+// pieces hashed by Hashers.
+func hashCreateFiles(files []createFile, pieceLength int) (string, error) {
+	totalLength := 0
+	for _, file := range files {
+		totalLength += file.length
+	}
+	hashes := make([][sha1.Size]byte, (totalLength+pieceLength-1)/pieceLength)
+	inFlight := make(chan struct{}, 2*runtime.NumCPU())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	numHashed := 0
+	hashPiece := func(piece []byte) {
+		pieceIndex := numHashed
+		numHashed++
+		inFlight <- struct{}{}
+		wg.Add(1)
+		Hashers.Go(func() {
+			defer wg.Done()
+			hashes[pieceIndex] = sha1.Sum(piece)
+			<-inFlight
+		})
+	}
+
+	piece := make([]byte, 0, pieceLength)
+	for _, file := range files {
+		f, err := os.Open(file.osPath)
+		if err != nil {
+			return "", err
+		}
+		remaining := file.length
+		for remaining > 0 {
+			n := pieceLength - len(piece)
+			if n > remaining {
+				n = remaining
+			}
+			start := len(piece)
+			piece = piece[:start+n]
+			if _, err := io.ReadFull(f, piece[start:]); err != nil {
+				f.Close()
+				return "", fmt.Errorf("Failed to read %s: %v", file.osPath, err)
+			}
+			remaining -= n
+			if len(piece) == pieceLength {
+				hashPiece(piece)
+				piece = make([]byte, 0, pieceLength)
+			}
+		}
+		f.Close()
+	}
+	if len(piece) > 0 {
+		hashPiece(piece)
+	}
+	wg.Wait()
+
+	var pieces strings.Builder
+	for _, hash := range hashes {
+		pieces.Write(hash[:])
+	}
+	return pieces.String(), nil
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Queries in flight at once during a lookup.
+	dhtAlpha        = 3
+	dhtQueryTimeout = 3 * time.Second
+
+	dhtTokenRotation      = 5 * time.Minute
+	dhtPeerExpiry         = 30 * time.Minute
+	dhtMaxPeersPerTorrent = 500
+	dhtMaxValues          = 50 // peers per 'get_peers' response
+	dhtRefreshInterval    = 15 * time.Minute
+	dhtSaveInterval       = 10 * time.Minute
+	dhtMaintenanceTick    = time.Minute
+	// How often a downloader looks up (and announces) its torrent.
+	dhtAnnounceInterval = 15 * time.Minute
+
+	// Env vars to configure the DHT. The state file keeps our node id and
+	// routing table between runs; set it to "off" to not persist them. The
+	// bootstrap nodes are a comma-separated list of host:port.
+	DHTStateFileEnv = "BITTORRENT_DHT_STATE"
+	DHTBootstrapEnv = "BITTORRENT_DHT_BOOTSTRAP"
+)
+
+var DefaultDHTBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+	"dht.libtorrent.org:25401",
+}
+
+// KRPC error codes.
+const (
+	krpcErrorGeneric  = 201
+	krpcErrorProtocol = 203
+	krpcErrorMethod   = 204
+)
+
+type DHTConfig struct {
+	StatePath      string // empty to not persist the routing table
+	BootstrapNodes []string
+}
+
+func DHTConfigFromEnv() DHTConfig {
+	config := DHTConfig{BootstrapNodes: DefaultDHTBootstrapNodes}
+
+	switch statePath := os.Getenv(DHTStateFileEnv); statePath {
+	case "off":
+	case "":
+		if cacheDir, err := os.UserCacheDir(); err == nil {
+			config.StatePath = filepath.Join(cacheDir, "bittorrent-go", "dht.dat")
+		}
+	default:
+		config.StatePath = statePath
+	}
+
+	if nodes := os.Getenv(DHTBootstrapEnv); nodes != "" {
+		config.BootstrapNodes = strings.Split(nodes, ",")
+	}
+
+	return config
+}
+
+type dhtStoredPeer struct {
+	peer      Peer
+	announced time.Time
+}
+
+type dhtPendingQuery struct {
+	addr     string
+	response chan map[string]interface{}
+}
+
+// DHT is a node of the Mainline DHT (BEP 5), used to find peers without a
+// tracker. It speaks KRPC (bencoded dicts over UDP), answers the queries of
+// other nodes, and stores the peers announced to it.
+type DHT struct {
+	conn   net.PacketConn
+	id     NodeId
+	table  *routingTable
+	config DHTConfig
+
+	mu         sync.Mutex
+	nextTid    uint16
+	pending    map[string]*dhtPendingQuery
+	peers      map[NodeId]map[string]dhtStoredPeer
+	secret     []byte
+	prevSecret []byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDHT runs a DHT node on conn, restoring the routing table saved at
+// config.StatePath if there is one.
+func NewDHT(conn net.PacketConn, config DHTConfig) (*DHT, error) {
+	d := &DHT{
+		conn:    conn,
+		id:      RandomNodeId(),
+		config:  config,
+		pending: make(map[string]*dhtPendingQuery),
+		peers:   make(map[NodeId]map[string]dhtStoredPeer),
+		secret:  randomSecret(),
+		closed:  make(chan struct{}),
+	}
+
+	var savedNodes []*dhtNode
+	if config.StatePath != "" {
+		id, nodes, err := loadDHTState(config.StatePath)
+		if err == nil {
+			d.id = id
+			savedNodes = nodes
+		} else if !os.IsNotExist(err) {
+			fmt.Printf("Ignoring DHT state file %s: %v\n", config.StatePath, err)
+		}
+	}
+	d.prevSecret = d.secret
+	d.table = newRoutingTable(d.id)
+	for _, node := range savedNodes {
+		d.table.Seen(node.id, node.addr)
+	}
+
+	go d.readLoop()
+	go d.maintain()
+
+	return d, nil
+}
+
+// StartDHT runs a DHT node on conn, configured from the environment, and
+// bootstraps it in the background.
+func StartDHT(ctx context.Context, conn net.PacketConn) (*DHT, error) {
+	d, err := NewDHT(conn, DHTConfigFromEnv())
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := d.Bootstrap(ctx); err != nil {
+			fmt.Printf("DHT bootstrap failed: %v\n", err)
+		}
+	}()
+
+	return d, nil
+}
+
+func (d *DHT) Addr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+// Close saves the routing table and stops the node.
+func (d *DHT) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		if d.config.StatePath != "" {
+			err = d.saveState()
+		}
+		d.conn.Close()
+	})
+	return err
+}
+
+func randomSecret() []byte {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// --- KRPC transport ---
+
+func (d *DHT) send(addr *net.UDPAddr, msg map[string]interface{}) error {
+	_, err := d.conn.WriteTo([]byte(Bencode(msg)), addr)
+	return err
+}
+
+// query sends a KRPC query to addr and waits for the response dict.
+func (d *DHT) query(ctx context.Context, addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = string(d.id[:])
+
+	d.mu.Lock()
+	d.nextTid++
+	tid := string([]byte{byte(d.nextTid >> 8), byte(d.nextTid)})
+	pq := &dhtPendingQuery{addr.String(), make(chan map[string]interface{}, 1)}
+	d.pending[tid] = pq
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, tid)
+		d.mu.Unlock()
+	}()
+
+	msg := map[string]interface{}{"t": tid, "y": "q", "q": method, "a": args}
+	if err := d.send(addr, msg); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dhtQueryTimeout)
+	defer cancel()
+	var resp map[string]interface{}
+	select {
+	case resp = <-pq.response:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.closed:
+		return nil, errors.New("DHT closed")
+	}
+
+	if resp["y"] == "e" {
+		return nil, fmt.Errorf("KRPC error from %s: %v", addr, resp["e"])
+	}
+	r, ok := resp["r"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Malformed KRPC response from %s", addr)
+	}
+	id, ok := dictNodeId(r, "id")
+	if !ok {
+		return nil, fmt.Errorf("KRPC response from %s has no node id", addr)
+	}
+	d.table.Seen(id, addr)
+
+	return r, nil
+}
+
+func (d *DHT) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-d.closed:
+				return
+			default:
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n == 0 || buf[0] != 'd' {
+			continue
+		}
+		d.handlePacket(string(buf[:n]), udpAddr)
+	}
+}
+
+func (d *DHT) handlePacket(packet string, addr *net.UDPAddr) {
+	decoded, err := DecodeBencode(packet)
+	if err != nil {
+		return
+	}
+	msg, ok := decoded.(map[string]interface{})
+	if !ok {
+		return
+	}
+	tid, _ := msg["t"].(string)
+
+	switch msg["y"] {
+	case "q":
+		d.handleQuery(tid, msg, addr)
+	case "r", "e":
+		d.mu.Lock()
+		pq, ok := d.pending[tid]
+		d.mu.Unlock()
+		if ok && pq.addr == addr.String() {
+			select {
+			case pq.response <- msg:
+			default:
+			}
+		}
+	}
+}
+
+func (d *DHT) replyError(tid string, addr *net.UDPAddr, code int, message string) {
+	d.send(addr, map[string]interface{}{
+		"t": tid,
+		"y": "e",
+		"e": []interface{}{code, message},
+	})
+}
+
+func (d *DHT) handleQuery(tid string, msg map[string]interface{}, addr *net.UDPAddr) {
+	method, _ := msg["q"].(string)
+	args, ok := msg["a"].(map[string]interface{})
+	if !ok {
+		d.replyError(tid, addr, krpcErrorProtocol, "missing arguments")
+		return
+	}
+	id, ok := dictNodeId(args, "id")
+	if !ok {
+		d.replyError(tid, addr, krpcErrorProtocol, "missing node id")
+		return
+	}
+	d.table.Seen(id, addr)
+
+	r := map[string]interface{}{"id": string(d.id[:])}
+	switch method {
+	case "ping":
+	case "find_node":
+		target, ok := dictNodeId(args, "target")
+		if !ok {
+			d.replyError(tid, addr, krpcErrorProtocol, "missing target")
+			return
+		}
+		r["nodes"] = string(compactNodeInfo(d.table.Closest(target, dhtK)))
+	case "get_peers":
+		infoHash, ok := dictNodeId(args, "info_hash")
+		if !ok {
+			d.replyError(tid, addr, krpcErrorProtocol, "missing info_hash")
+			return
+		}
+		d.mu.Lock()
+		secret := d.secret
+		d.mu.Unlock()
+		r["token"] = d.token(addr.IP, secret)
+		if values := d.storedPeers(infoHash); len(values) > 0 {
+			r["values"] = values
+		} else {
+			r["nodes"] = string(compactNodeInfo(d.table.Closest(infoHash, dhtK)))
+		}
+	case "announce_peer":
+		infoHash, ok := dictNodeId(args, "info_hash")
+		if !ok {
+			d.replyError(tid, addr, krpcErrorProtocol, "missing info_hash")
+			return
+		}
+		token, _ := args["token"].(string)
+		if !d.validToken(token, addr.IP) {
+			d.replyError(tid, addr, krpcErrorProtocol, "bad token")
+			return
+		}
+		port, _ := args["port"].(int)
+		if impliedPort, _ := args["implied_port"].(int); impliedPort == 1 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			d.replyError(tid, addr, krpcErrorProtocol, "bad port")
+			return
+		}
+		d.storePeer(infoHash, Peer{Ip: addr.IP, Port: uint(port)})
+	default:
+		d.replyError(tid, addr, krpcErrorMethod, "method unknown")
+		return
+	}
+
+	d.send(addr, map[string]interface{}{"t": tid, "y": "r", "r": r})
+}
+
+func dictNodeId(dict map[string]interface{}, key string) (NodeId, bool) {
+	var id NodeId
+	val, ok := dict[key].(string)
+	if !ok || len(val) != len(id) {
+		return id, false
+	}
+	copy(id[:], val)
+	return id, true
+}
+
+// --- Tokens and stored peers ---
+
+// token proves to us that a node announcing a peer asked for peers first
+// from the same IP. Tokens stay valid for up to two secret rotations.
+func (d *DHT) token(ip net.IP, secret []byte) string {
+	hash := sha1.Sum(append(append([]byte{}, secret...), ip...))
+	return string(hash[:8])
+}
+
+func (d *DHT) validToken(token string, ip net.IP) bool {
+	d.mu.Lock()
+	secret, prevSecret := d.secret, d.prevSecret
+	d.mu.Unlock()
+	return token == d.token(ip, secret) || token == d.token(ip, prevSecret)
+}
+
+func (d *DHT) storePeer(infoHash NodeId, peer Peer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	peers, ok := d.peers[infoHash]
+	if !ok {
+		peers = make(map[string]dhtStoredPeer)
+		d.peers[infoHash] = peers
+	}
+	if _, ok := peers[peer.Addr()]; !ok && len(peers) >= dhtMaxPeersPerTorrent {
+		return
+	}
+	peers[peer.Addr()] = dhtStoredPeer{peer, time.Now()}
+}
+
+func (d *DHT) storedPeers(infoHash NodeId) []interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	values := make([]interface{}, 0, dhtMaxValues)
+	for _, stored := range d.peers[infoHash] {
+		if len(values) >= dhtMaxValues {
+			break
+		}
+		if stored.peer.Ip.To4() != nil {
+			values = append(values, string(compactPeer(stored.peer)))
+		}
+	}
+	return values
+}
+
+// --- Lookups ---
+
+type dhtLookupReply struct {
+	node *dhtNode
+	resp map[string]interface{}
+	err  error
+}
+
+// lookup iteratively queries the nodes closest to target, alpha at a time,
+// until the dhtK closest nodes it heard of have all answered. With getPeers
+// it sends 'get_peers' queries and also collects the peers and tokens.
+func (d *DHT) lookup(ctx context.Context, target NodeId, getPeers bool) ([]Peer, []*dhtNode, map[NodeId]string) {
+	candidates := d.table.Closest(target, dhtK)
+	if len(candidates) < dhtK {
+		// Bootstrap nodes have unknown ids, so they are queried first.
+		candidates = append(d.bootstrapNodes(ctx), candidates...)
+	}
+
+	queried := make(map[string]bool)
+	failed := make(map[string]bool)
+	var responded []*dhtNode
+	tokens := make(map[NodeId]string)
+	peers := make(map[string]Peer)
+
+	method := "find_node"
+	if getPeers {
+		method = "get_peers"
+	}
+	replies := make(chan dhtLookupReply, dhtAlpha)
+	inFlight := 0
+
+	for {
+		for inFlight < dhtAlpha && ctx.Err() == nil {
+			next := nextLookupCandidate(candidates, queried, failed)
+			if next == nil {
+				break
+			}
+			queried[next.addr.String()] = true
+			inFlight++
+
+			go func(node *dhtNode) {
+				args := map[string]interface{}{"target": string(target[:])}
+				if getPeers {
+					args = map[string]interface{}{"info_hash": string(target[:])}
+				}
+				resp, err := d.query(ctx, node.addr, method, args)
+				replies <- dhtLookupReply{node, resp, err}
+			}(next)
+		}
+		if inFlight == 0 {
+			break
+		}
+
+		reply := <-replies
+		inFlight--
+		if reply.err != nil {
+			failed[reply.node.addr.String()] = true
+			d.table.Failed(reply.node.id)
+			continue
+		}
+
+		id, _ := dictNodeId(reply.resp, "id")
+		reply.node.id = id
+		responded = append(responded, reply.node)
+		if token, ok := reply.resp["token"].(string); ok {
+			tokens[id] = token
+		}
+		if values, ok := reply.resp["values"].([]interface{}); ok {
+			for _, value := range values {
+				if compact, ok := value.(string); ok {
+					for _, peer := range parseCompactPeers([]byte(compact)) {
+						peers[peer.Addr()] = peer
+					}
+				}
+			}
+		}
+		if nodes, ok := reply.resp["nodes"].(string); ok {
+			for _, node := range parseCompactNodeInfo([]byte(nodes)) {
+				if !queried[node.addr.String()] && node.id != d.id {
+					candidates = append(candidates, node)
+				}
+			}
+			sortCandidates(candidates, target)
+		}
+	}
+
+	sortByDistance(responded, target)
+	if len(responded) > dhtK {
+		responded = responded[:dhtK]
+	}
+	peerList := make([]Peer, 0, len(peers))
+	for _, peer := range peers {
+		peerList = append(peerList, peer)
+	}
+
+	return peerList, responded, tokens
+}
+
+// nextLookupCandidate returns the closest candidate not queried yet, if it is
+// among the dhtK closest candidates that didn't fail.
+func nextLookupCandidate(candidates []*dhtNode, queried map[string]bool, failed map[string]bool) *dhtNode {
+	considered := 0
+	for _, node := range candidates {
+		addr := node.addr.String()
+		if failed[addr] {
+			continue
+		}
+		if node.id != (NodeId{}) {
+			considered++
+		}
+		if !queried[addr] {
+			return node
+		}
+		if considered >= dhtK {
+			break
+		}
+	}
+	return nil
+}
+
+// sortCandidates sorts by distance to target, keeping the bootstrap nodes,
+// whose ids we don't know, in front.
+func sortCandidates(candidates []*dhtNode, target NodeId) {
+	known := candidates[:0:0]
+	for _, node := range candidates {
+		if node.id != (NodeId{}) {
+			known = append(known, node)
+		}
+	}
+	sortByDistance(known, target)
+
+	i := 0
+	for _, node := range candidates {
+		if node.id == (NodeId{}) {
+			candidates[i] = node
+			i++
+		}
+	}
+	copy(candidates[i:], known)
+}
+
+func (d *DHT) bootstrapNodes(ctx context.Context) []*dhtNode {
+	var nodes []*dhtNode
+	for _, hostPort := range d.config.BootstrapNodes {
+		addr, err := resolveUDPAddr(ctx, strings.TrimSpace(hostPort))
+		if err != nil {
+			fmt.Printf("Failed to resolve DHT bootstrap node %s: %v\n", hostPort, err)
+			continue
+		}
+		nodes = append(nodes, &dhtNode{addr: addr})
+	}
+	return nodes
+}
+
+func resolveUDPAddr(ctx context.Context, hostPort string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, "udp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0], Port: port}, nil
+}
+
+// Bootstrap fills the routing table by looking up our own id.
+func (d *DHT) Bootstrap(ctx context.Context) error {
+	d.lookup(ctx, d.id, false)
+	if d.table.Len() == 0 {
+		return fmt.Errorf("No DHT nodes answered")
+	}
+	return nil
+}
+
+// GetPeers looks up the peers of a torrent. If announcePort isn't 0, it also
+// announces that we accept connections for the torrent on that port.
+func (d *DHT) GetPeers(ctx context.Context, infoHash []byte, announcePort int) ([]Peer, error) {
+	var target NodeId
+	if len(infoHash) != len(target) {
+		return nil, fmt.Errorf("Expected a %d byte info hash, got %d bytes", len(target), len(infoHash))
+	}
+	copy(target[:], infoHash)
+
+	peers, closest, tokens := d.lookup(ctx, target, true)
+	if announcePort == 0 {
+		return peers, nil
+	}
+
+	var wg sync.WaitGroup
+	for _, node := range closest {
+		token, ok := tokens[node.id]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(node *dhtNode, token string) {
+			defer wg.Done()
+			d.query(ctx, node.addr, "announce_peer", map[string]interface{}{
+				"info_hash": string(target[:]),
+				"port":      announcePort,
+				"token":     token,
+			})
+		}(node, token)
+	}
+	wg.Wait()
+
+	return peers, nil
+}
+
+// --- Maintenance and persistence ---
+
+func (d *DHT) maintain() {
+	ticker := time.NewTicker(dhtMaintenanceTick)
+	defer ticker.Stop()
+	lastRotation, lastRefresh, lastSave := time.Now(), time.Now(), time.Now()
+
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(lastRotation) >= dhtTokenRotation {
+			d.mu.Lock()
+			d.prevSecret, d.secret = d.secret, randomSecret()
+			d.mu.Unlock()
+			lastRotation = time.Now()
+		}
+		d.expirePeers()
+		if time.Since(lastRefresh) >= dhtRefreshInterval {
+			d.refresh()
+			lastRefresh = time.Now()
+		}
+		if d.config.StatePath != "" && time.Since(lastSave) >= dhtSaveInterval {
+			if err := d.saveState(); err != nil {
+				fmt.Printf("Failed to save DHT state: %v\n", err)
+			}
+			lastSave = time.Now()
+		}
+	}
+}
+
+func (d *DHT) expirePeers() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for infoHash, peers := range d.peers {
+		for addr, stored := range peers {
+			if time.Since(stored.announced) > dhtPeerExpiry {
+				delete(peers, addr)
+			}
+		}
+		if len(peers) == 0 {
+			delete(d.peers, infoHash)
+		}
+	}
+}
+
+// refresh pings the nodes we haven't heard from lately, so that dead ones
+// get replaced, and looks up our own id again to learn about new nodes.
+func (d *DHT) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), dhtRefreshInterval/2)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, node := range d.table.Questionable() {
+		wg.Add(1)
+		go func(node *dhtNode) {
+			defer wg.Done()
+			if _, err := d.query(ctx, node.addr, "ping", map[string]interface{}{}); err != nil {
+				d.table.Failed(node.id)
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	d.lookup(ctx, d.id, false)
+}
+
+func (d *DHT) saveState() error {
+	nodes := d.table.Closest(d.id, d.table.Len())
+	state := map[string]interface{}{
+		"id":    string(d.id[:]),
+		"nodes": string(compactNodeInfo(nodes)),
+	}
+
+	if err := os.MkdirAll(filepath.Dir(d.config.StatePath), 0700); err != nil {
+		return err
+	}
+	tmpPath := d.config.StatePath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(Bencode(state)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, d.config.StatePath)
+}
+
+func loadDHTState(path string) (NodeId, []*dhtNode, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return NodeId{}, nil, err
+	}
+	decoded, err := DecodeBencode(string(data))
+	if err != nil {
+		return NodeId{}, nil, err
+	}
+	state, ok := decoded.(map[string]interface{})
+	if !ok {
+		return NodeId{}, nil, fmt.Errorf("Unexpected type in DHT state. Expected dict.")
+	}
+	id, ok := dictNodeId(state, "id")
+	if !ok {
+		return NodeId{}, nil, fmt.Errorf("DHT state has no node id")
+	}
+	nodes, _ := state["nodes"].(string)
+
+	return id, parseCompactNodeInfo([]byte(nodes)), nil
+}
+
+// UseDHT makes the downloader look up peers on the DHT, and announce itself
+// there if it's listening. It must be called before Run.
+func (d *Downloader) UseDHT(dht *DHT) {
+	// Private torrents (BEP 27) must not be announced on the DHT.
+	if d.torr.info.private {
+		return
+	}
+	d.dht = dht
+}
+
+func (d *Downloader) lookupDHT(ctx context.Context) {
+	ticker := time.NewTicker(dhtAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		peers, err := d.dht.GetPeers(ctx, d.infoHash, d.listenPort)
+		if err != nil {
+			fmt.Printf("DHT lookup failed: %v\n", err)
+		} else {
+			fmt.Printf("Found %d peers on the DHT\n", len(peers))
+			d.AddPeers(peers)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
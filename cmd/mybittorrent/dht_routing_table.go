@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Nodes per k-bucket, and the number of closest nodes lookups return.
+	dhtK = 8
+	// A node that misses this many queries in a row is replaced by new nodes.
+	dhtMaxNodeFailures = 3
+	// Nodes not heard from for this long are pinged by the refresh.
+	dhtNodeQuestionableAge = 15 * time.Minute
+)
+
+type NodeId [20]byte
+
+func RandomNodeId() NodeId {
+	var id NodeId
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// xor is the Kademlia distance between two ids.
+func (id NodeId) xor(other NodeId) NodeId {
+	var dist NodeId
+	for i := range id {
+		dist[i] = id[i] ^ other[i]
+	}
+	return dist
+}
+
+func (id NodeId) less(other NodeId) bool {
+	for i := range id {
+		if id[i] != other[i] {
+			return id[i] < other[i]
+		}
+	}
+	return false
+}
+
+// commonPrefixLen is the number of leading bits id shares with other.
+func (id NodeId) commonPrefixLen(other NodeId) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(id) * 8
+}
+
+type dhtNode struct {
+	id       NodeId
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+// compactNodeInfo encodes nodes as in 'find_node' responses: 20 bytes of id
+// followed by 6 bytes of IPv4 address and port, per node.
+func compactNodeInfo(nodes []*dhtNode) []byte {
+	compact := make([]byte, 0, 26*len(nodes))
+	for _, node := range nodes {
+		ip := node.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		compact = append(compact, node.id[:]...)
+		compact = append(compact, ip...)
+		compact = append(compact, byte(node.addr.Port>>8), byte(node.addr.Port))
+	}
+	return compact
+}
+
+func parseCompactNodeInfo(compact []byte) []*dhtNode {
+	nodes := make([]*dhtNode, 0, len(compact)/26)
+	for i := 0; i+26 <= len(compact); i += 26 {
+		node := &dhtNode{addr: &net.UDPAddr{
+			IP:   net.IP(append([]byte{}, compact[i+20:i+24]...)),
+			Port: int(binary.BigEndian.Uint16(compact[i+24 : i+26])),
+		}}
+		copy(node.id[:], compact[i:i+20])
+		if node.addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// routingTable keeps up to dhtK nodes per distance from our own id. Bucket i
+// holds the nodes that share exactly i leading bits with us, so we know many
+// nodes close to us and a few far away.
+type routingTable struct {
+	mu      sync.Mutex
+	self    NodeId
+	buckets [161][]*dhtNode
+}
+
+func newRoutingTable(self NodeId) *routingTable {
+	return &routingTable{self: self}
+}
+
+func (rt *routingTable) bucketIndex(id NodeId) int {
+	return rt.self.commonPrefixLen(id)
+}
+
+// Seen records that a node responded to us or queried us. It returns false
+// if the node didn't fit in its bucket.
+func (rt *routingTable) Seen(id NodeId, addr *net.UDPAddr) bool {
+	if id == rt.self || addr.IP.To4() == nil {
+		return false
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	i := rt.bucketIndex(id)
+	bucket := rt.buckets[i]
+	for j, node := range bucket {
+		if node.id == id {
+			node.addr = addr
+			node.lastSeen = time.Now()
+			node.failures = 0
+			// Keep the buckets ordered by last contact.
+			rt.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), node)
+			return true
+		}
+	}
+
+	node := &dhtNode{id: id, addr: addr, lastSeen: time.Now()}
+	if len(bucket) < dhtK {
+		rt.buckets[i] = append(bucket, node)
+		return true
+	}
+	for j, old := range bucket {
+		if old.failures >= dhtMaxNodeFailures {
+			rt.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), node)
+			return true
+		}
+	}
+	return false
+}
+
+// Failed records that a node didn't answer a query.
+func (rt *routingTable) Failed(id NodeId) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, node := range rt.buckets[rt.bucketIndex(id)] {
+		if node.id == id {
+			node.failures++
+			return
+		}
+	}
+}
+
+// Closest returns up to n known nodes, closest to target first.
+func (rt *routingTable) Closest(target NodeId, n int) []*dhtNode {
+	rt.mu.Lock()
+	nodes := make([]*dhtNode, 0, 64)
+	for _, bucket := range rt.buckets {
+		for _, node := range bucket {
+			if node.failures < dhtMaxNodeFailures {
+				copied := *node
+				nodes = append(nodes, &copied)
+			}
+		}
+	}
+	rt.mu.Unlock()
+
+	sortByDistance(nodes, target)
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// Questionable returns the nodes we haven't heard from in a while.
+func (rt *routingTable) Questionable() []*dhtNode {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var nodes []*dhtNode
+	for _, bucket := range rt.buckets {
+		for _, node := range bucket {
+			if time.Since(node.lastSeen) > dhtNodeQuestionableAge {
+				copied := *node
+				nodes = append(nodes, &copied)
+			}
+		}
+	}
+	return nodes
+}
+
+func (rt *routingTable) Len() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+func sortByDistance(nodes []*dhtNode, target NodeId) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].id.xor(target).less(nodes[j].id.xor(target))
+	})
+}
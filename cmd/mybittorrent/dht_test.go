@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestDHT starts a DHT node on a loopback port, bootstrapping from the
+// given nodes.
+func newTestDHT(t *testing.T, bootstrap ...*DHT) *DHT {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := DHTConfig{}
+	for _, node := range bootstrap {
+		config.BootstrapNodes = append(config.BootstrapNodes, node.Addr().String())
+	}
+	d, err := NewDHT(conn, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestDHTAnnounceAndGetPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first := newTestDHT(t)
+	announcer := newTestDHT(t, first)
+	seeker := newTestDHT(t, first)
+	for _, d := range []*DHT{announcer, seeker} {
+		if err := d.Bootstrap(ctx); err != nil {
+			t.Fatalf("Failed to bootstrap: %v", err)
+		}
+	}
+
+	infoHash := []byte("0123456789abcdefghij")
+	if _, err := announcer.GetPeers(ctx, infoHash, 6881); err != nil {
+		t.Fatalf("Failed to announce: %v", err)
+	}
+	peers, err := seeker.GetPeers(ctx, infoHash, 0)
+	if err != nil {
+		t.Fatalf("Failed to get peers: %v", err)
+	}
+	if len(peers) != 1 || !peers[0].Ip.Equal(net.IPv4(127, 0, 0, 1)) || peers[0].Port != 6881 {
+		t.Fatalf("Got peers %v, expected 127.0.0.1:6881", peers)
+	}
+}
+
+func TestDHTGetPeersUnknownInfoHash(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first := newTestDHT(t)
+	seeker := newTestDHT(t, first)
+	if err := seeker.Bootstrap(ctx); err != nil {
+		t.Fatalf("Failed to bootstrap: %v", err)
+	}
+	peers, err := seeker.GetPeers(ctx, []byte("jihgfedcba9876543210"), 0)
+	if err != nil {
+		t.Fatalf("Failed to get peers: %v", err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("Got peers %v, expected none", peers)
+	}
+}
@@ -0,0 +1,777 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type Piece []byte
+
+const (
+	MaxPeers = 30
+
+	// Requests kept in flight to each peer, so the connection never idles
+	// waiting for us to ask for the next block.
+	maxOutstandingRequests = 16
+	// Block requests larger than this are ignored, as most clients do.
+	maxServedBlockSize = 128 * 1024
+
+	// Peers that sit on our requests for this long without sending a block
+	// are dropped, so their blocks can be requested from someone else.
+	requestTimeout    = time.Minute
+	idleCheckInterval = 10 * time.Second
+)
+
+// peerState is what the download engine knows about a connected peer.
+type peerState struct {
+	bitfield    Bitfield
+	gotBitfield bool
+	// When the peer last sent us a block, or was first asked for one since.
+	lastBlock time.Time
+
+	// Fast Extension state: the pieces the peer lets us download while
+	// choked, the ones it suggested, and the ones we let it download.
+	allowedFast map[int]bool
+	suggested   []int
+	grantedFast map[int]bool
+
+	// Extension protocol state: the ids the peer assigned to extension
+	// messages, its listen port, and the peers we last told it about.
+	extensions map[string]int
+	listenPort int
+	pexSent    map[string]Peer
+}
+
+type dialResult struct {
+	peer     Peer
+	peerConn *PeerConn
+	err      error
+}
+
+// Downloader is the download engine for a torrent. It connects to peers added
+// with AddPeers (and accepts the ones arriving on Listen), and consumes the
+// events of all peer connections on a single goroutine, which owns the piece
+// picker.
+type Downloader struct {
+	torr      *torrent
+	infoHash  []byte
+	numPieces int
+
+	picker  *PiecePicker
+	choker  *Choker
+	storage Storage // holds the verified pieces
+	// Closed once each piece is verified, for readers waiting on it.
+	verified   []chan struct{}
+	priorities chan []int
+	hashed     chan hashResult
+	hashing    int   // pieces with the hash pool
+	err        error // stops the download, e.g. a failed write
+	// With seed set, Run keeps uploading once all wanted pieces are verified,
+	// which closes completed.
+	seed      bool
+	completed chan struct{}
+
+	filePriorities []Priority
+
+	peers       map[*PeerConn]*peerState
+	dialing     int
+	listenPort  int  // 0 unless Listen was called
+	dht         *DHT // nil unless UseDHT was called
+	lsd         *LSD // nil unless UseLSD was called
+	webSeeds    []string
+	events      chan PeerEvent
+	dialResults chan dialResult
+	incoming    chan *PeerConn
+	done        chan struct{}
+
+	// mu guards the peer candidates, which are added from other goroutines.
+	mu         sync.Mutex
+	candidates []Peer
+	known      map[string]bool
+	wake       chan struct{}
+
+	// Hash failures each peer took part in, and the peers banned for them,
+	// by IP address.
+	strikes map[string]int
+	banned  map[string]bool
+
+	// Limits on the torrent's traffic, and on that of each of its peers.
+	downloadLimit     *RateLimiter
+	uploadLimit       *RateLimiter
+	peerDownloadLimit *RateLimiter
+	peerUploadLimit   *RateLimiter
+}
+
+func NewDownloader(torr *torrent, infoHash []byte) *Downloader {
+	numPieces := torr.info.numPieces()
+	d := &Downloader{
+		torr:        torr,
+		infoHash:    infoHash,
+		numPieces:   numPieces,
+		picker:      NewPiecePicker(numPieces, torr.info.pieceLength, torr.info.length),
+		storage:     NewMemoryStorage(&torr.info),
+		verified:    make([]chan struct{}, numPieces),
+		priorities:  make(chan []int),
+		hashed:      make(chan hashResult),
+		peers:       make(map[*PeerConn]*peerState),
+		events:      make(chan PeerEvent),
+		dialResults: make(chan dialResult),
+		incoming:    make(chan *PeerConn),
+		done:        make(chan struct{}),
+		completed:   make(chan struct{}),
+		known:       make(map[string]bool),
+		wake:        make(chan struct{}, 1),
+		strikes:     make(map[string]int),
+		banned:      make(map[string]bool),
+
+		downloadLimit:     NewRateLimiter(0),
+		uploadLimit:       NewRateLimiter(0),
+		peerDownloadLimit: NewRateLimiter(0),
+		peerUploadLimit:   NewRateLimiter(0),
+	}
+	for i := range d.verified {
+		d.verified[i] = make(chan struct{})
+	}
+	d.filePriorities = make([]Priority, len(torr.info.files))
+	for i, file := range torr.info.files {
+		if !file.padding {
+			d.filePriorities[i] = PriorityNormal
+		}
+	}
+	d.choker = NewChoker(DefaultUploadSlots, d.seeding)
+
+	return d
+}
+
+// SetWanted selects whether a piece should be downloaded. All pieces are
+// wanted by default. It must be called before Run.
+func (d *Downloader) SetWanted(pieceIndex int, wanted bool) {
+	d.picker.SetWanted(pieceIndex, wanted)
+}
+
+// SetFilePriority sets the priority of a file. Its pieces get it too, unless
+// they are shared with a file of higher priority. All files have
+// PriorityNormal by default. It must be called before Run.
+func (d *Downloader) SetFilePriority(fileIndex int, priority Priority) {
+	d.filePriorities[fileIndex] = priority
+	first, last := d.torr.info.filePieces(fileIndex)
+	for pieceIndex := first; pieceIndex <= last; pieceIndex++ {
+		d.picker.SetPriority(pieceIndex, d.piecePriority(pieceIndex))
+	}
+}
+
+func (d *Downloader) piecePriority(pieceIndex int) Priority {
+	priority := PrioritySkip
+	offset := pieceIndex * d.torr.info.pieceLength
+	for _, segment := range d.torr.info.fileSegments(offset, d.picker.PieceSize(pieceIndex)) {
+		if d.filePriorities[segment.file] > priority {
+			priority = d.filePriorities[segment.file]
+		}
+	}
+	return priority
+}
+
+// SetSeed makes Run keep uploading to peers after the download, until its
+// context is done. It must be called before Run.
+func (d *Downloader) SetSeed(seed bool) {
+	d.seed = seed
+}
+
+// Completed is closed once all wanted pieces are verified.
+func (d *Downloader) Completed() <-chan struct{} {
+	return d.completed
+}
+
+func (d *Downloader) seeding() bool {
+	select {
+	case <-d.completed:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetSequential makes the downloader fetch pieces in order, rather than
+// rarest first. It must be called before Run.
+func (d *Downloader) SetSequential(sequential bool) {
+	d.picker.SetSequential(sequential)
+}
+
+// SetRateLimits limits the download and upload rates of the torrent, and of
+// each of its peers, in bytes per second. 0 is no limit. The global limits
+// apply too, so the torrent's own are only needed by programs that run
+// several torrents. It is safe to call at any time, from any goroutine.
+func (d *Downloader) SetRateLimits(download int, upload int, peerDownload int, peerUpload int) {
+	d.downloadLimit.SetRate(download)
+	d.uploadLimit.SetRate(upload)
+	d.peerDownloadLimit.SetRate(peerDownload)
+	d.peerUploadLimit.SetRate(peerUpload)
+}
+
+// SetVerified marks a piece the storage already holds as downloaded, e.g. one
+// verified when resuming. It must be called before Run.
+func (d *Downloader) SetVerified(pieceIndex int) {
+	if !d.isVerified(pieceIndex) {
+		d.picker.MarkDone(pieceIndex)
+		close(d.verified[pieceIndex])
+	}
+}
+
+// SetStorage makes the downloader keep the pieces in storage, rather than in
+// memory. It must be called before Run.
+func (d *Downloader) SetStorage(storage Storage) {
+	d.storage = storage
+}
+
+// Piece returns a verified piece, or nil if it hasn't been downloaded or
+// can't be read back.
+func (d *Downloader) Piece(pieceIndex int) Piece {
+	if !d.isVerified(pieceIndex) {
+		return nil
+	}
+	piece := make(Piece, d.torr.info.pieceSize(pieceIndex))
+	if _, err := d.storage.ReadAt(piece, pieceIndex, 0); err != nil {
+		fmt.Printf("%v\n", err)
+		return nil
+	}
+	return piece
+}
+
+// AddPeers adds candidate peers to connect to. It is safe to call from any
+// goroutine.
+func (d *Downloader) AddPeers(peers []Peer) {
+	d.mu.Lock()
+	for _, peer := range peers {
+		addr := peer.Addr()
+		if d.known[addr] {
+			continue
+		}
+		d.known[addr] = true
+		d.candidates = append(d.candidates, peer)
+	}
+	d.mu.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// infoHashes are the info hashes peers may connect with. Hybrid torrents have
+// a v1 one and a v2 one, truncated to 20 bytes.
+func (d *Downloader) infoHashes() [][]byte {
+	infoHashes := [][]byte{d.infoHash}
+	if v2 := d.torr.infoHashV2; v2 != nil && !bytes.Equal(v2[:20], d.infoHash) {
+		infoHashes = append(infoHashes, v2[:20])
+	}
+	return infoHashes
+}
+
+// Listen accepts incoming peer connections on listener until Run returns.
+func (d *Downloader) Listen(ctx context.Context, listener net.Listener) {
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		d.listenPort = addr.Port
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				peerConn, err := AcceptPeer(ctx, conn, d.infoHashes(), true)
+				if err != nil {
+					fmt.Printf("Rejected incoming connection from %s: %v\n", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				select {
+				case d.incoming <- peerConn:
+				case <-d.done:
+					peerConn.Close()
+				}
+			}()
+		}
+	}()
+}
+
+// Run downloads the wanted pieces, and returns once they are all verified or
+// ctx is done. With SetSeed, it seeds them afterwards until ctx is done.
+func (d *Downloader) Run(ctx context.Context) error {
+	defer d.shutdown()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go d.choker.Run(ctx)
+
+	idleTicker := time.NewTicker(idleCheckInterval)
+	defer idleTicker.Stop()
+	pexTicker := time.NewTicker(pexInterval)
+	defer pexTicker.Stop()
+	if d.dht != nil {
+		go d.lookupDHT(ctx)
+	}
+	if d.lsd != nil {
+		go d.announceLSD(ctx)
+	}
+	for _, seedURL := range d.webSeeds {
+		d.addPeerConn(d.connectWebSeed(seedURL))
+	}
+
+	for {
+		if d.err != nil {
+			return d.err
+		}
+		if d.picker.Done() && !d.seeding() {
+			close(d.completed)
+			if !d.seed {
+				return nil
+			}
+			fmt.Println("Download complete, seeding.")
+		}
+		d.dialCandidates(ctx)
+		// With the DHT or LSD more peers may turn up, so keep waiting for them.
+		discovering := d.dht != nil || d.lsd != nil
+		if !d.seeding() && len(d.peers) == 0 && d.dialing == 0 && d.hashing == 0 && d.numCandidates() == 0 && !discovering {
+			return fmt.Errorf("No peers left to download from")
+		}
+
+		select {
+		case <-ctx.Done():
+			if d.seeding() {
+				return nil
+			}
+			return ctx.Err()
+		case <-idleTicker.C:
+			d.dropIdlePeers()
+		case <-pexTicker.C:
+			d.sendPex()
+		case ev := <-d.events:
+			d.handleEvent(ev)
+		case res := <-d.dialResults:
+			d.dialing--
+			if res.err != nil {
+				fmt.Printf("Failed to connect to peer %s: %v\n", res.peer.Ip, res.err)
+				continue
+			}
+			d.addPeerConn(res.peerConn)
+		case peerConn := <-d.incoming:
+			d.addPeerConn(peerConn)
+		case pieces := <-d.priorities:
+			d.prioritize(pieces)
+		case res := <-d.hashed:
+			d.hashing--
+			d.pieceHashed(res)
+		case <-d.wake:
+		}
+	}
+}
+
+func (d *Downloader) shutdown() {
+	close(d.done)
+	for peerConn := range d.peers {
+		peerConn.Close()
+	}
+}
+
+func (d *Downloader) numCandidates() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.candidates)
+}
+
+func (d *Downloader) dialCandidates(ctx context.Context) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for len(d.candidates) > 0 && len(d.peers)+d.dialing < MaxPeers {
+		peer := d.candidates[0]
+		d.candidates = d.candidates[1:]
+		if d.banned[peer.Ip.String()] {
+			continue
+		}
+		d.dialing++
+
+		go func(peer Peer) {
+			peerConn, err := ConnectToPeer(ctx, peer, d.infoHash, true)
+			select {
+			case d.dialResults <- dialResult{peer, peerConn, err}:
+			case <-d.done:
+				if peerConn != nil {
+					peerConn.Close()
+				}
+			}
+		}(peer)
+	}
+}
+
+func (d *Downloader) addPeerConn(peerConn *PeerConn) {
+	if len(d.peers) >= MaxPeers || d.banned[peerHost(peerConn)] {
+		peerConn.Close()
+		return
+	}
+	fmt.Printf("Connected to peer %s (%s)\n", peerConn.Conn.RemoteAddr(), ClientName(peerConn.Handshake.PeerId))
+
+	state := &peerState{
+		bitfield:    NewBitfield(d.numPieces),
+		allowedFast: make(map[int]bool),
+		grantedFast: make(map[int]bool),
+		extensions:  make(map[string]int),
+		pexSent:     make(map[string]Peer),
+	}
+	d.peers[peerConn] = state
+	// Web seeds limit their traffic with the server instead.
+	if _, ok := peerConn.Conn.(*webSeedConn); !ok {
+		peerConn.SetRateLimits(
+			[]*RateLimiter{GlobalDownloadLimit, d.downloadLimit, d.peerDownloadLimit.perPeer()},
+			[]*RateLimiter{GlobalUploadLimit, d.uploadLimit, d.peerUploadLimit.perPeer()},
+		)
+	}
+	peerConn.Start(d.events, d.done)
+	if peerConn.Handshake.SupportsExtensions() {
+		peerConn.Send(extendedHandshakeMessage(d.listenPort, d.torr.info.private))
+	}
+	d.sendBitfield(peerConn)
+	if peerConn.FastExtension() {
+		for _, pieceIndex := range allowedFastSet(peerConn.Peer.Ip, d.infoHash, d.numPieces, allowedFastSetSize) {
+			state.grantedFast[pieceIndex] = true
+			peerConn.Send(pieceIndexMessage(pmidAllowedFast, pieceIndex))
+		}
+	}
+	d.choker.AddPeer(peerConn)
+}
+
+func (d *Downloader) sendBitfield(peerConn *PeerConn) {
+	bitfield := d.picker.Bitfield()
+	numMissing := 0
+	for i := 0; i < d.numPieces; i++ {
+		if !bitfield.HasPiece(i) {
+			numMissing++
+		}
+	}
+
+	switch {
+	case peerConn.FastExtension() && numMissing == 0:
+		peerConn.Send(PeerMessage{pmidHaveAll, []byte{}})
+	case peerConn.FastExtension() && numMissing == d.numPieces:
+		peerConn.Send(PeerMessage{pmidHaveNone, []byte{}})
+	case numMissing < d.numPieces:
+		peerConn.Send(PeerMessage{pmidBitfield, bitfield})
+	}
+}
+
+func (d *Downloader) removePeer(peerConn *PeerConn) {
+	state, ok := d.peers[peerConn]
+	if !ok {
+		return
+	}
+	delete(d.peers, peerConn)
+	peerConn.Close()
+	d.choker.RemovePeer(peerConn)
+	d.picker.PeerGone(peerConn, state.bitfield)
+	if ws, ok := peerConn.Conn.(*webSeedConn); ok {
+		d.retryWebSeed(string(ws.addr))
+	}
+
+	// Other peers can pick up the blocks that were requested from this one.
+	d.requestFromAll()
+}
+
+func (d *Downloader) handleEvent(ev PeerEvent) {
+	peerConn := ev.Peer
+	state, ok := d.peers[peerConn]
+	if !ok {
+		return
+	}
+	if ev.Err != nil {
+		fmt.Printf("Lost connection to peer %s: %v\n", peerConn.Conn.RemoteAddr(), ev.Err)
+		d.removePeer(peerConn)
+		return
+	}
+
+	msg := ev.Msg
+	switch msg.id {
+	case pmidChoke:
+		// Without the Fast Extension, the peer silently discards our pending
+		// requests when it chokes us. With it, it rejects them one by one.
+		if !peerConn.FastExtension() {
+			d.picker.UnrequestAll(peerConn)
+			d.requestFromAll()
+		}
+	case pmidInterested:
+		d.choker.PeerBecameInterested(peerConn)
+	case pmidHave:
+		if len(msg.payload) != 4 {
+			d.dropPeer(peerConn, fmt.Errorf("Malformed 'have' msg: %x", msg.payload))
+			return
+		}
+		pieceIndex := int(binary.BigEndian.Uint32(msg.payload))
+		if pieceIndex < d.numPieces && !state.bitfield.HasPiece(pieceIndex) {
+			state.bitfield.SetPiece(pieceIndex)
+			d.picker.PeerHave(pieceIndex)
+		}
+	case pmidBitfield:
+		if state.gotBitfield {
+			break
+		}
+		state.gotBitfield = true
+		copy(state.bitfield, msg.payload)
+		d.picker.PeerBitfield(state.bitfield)
+	case pmidHaveAll, pmidHaveNone:
+		if !peerConn.FastExtension() || state.gotBitfield {
+			d.dropPeer(peerConn, fmt.Errorf("Unexpected msg with id %d", msg.id))
+			return
+		}
+		state.gotBitfield = true
+		if msg.id == pmidHaveAll {
+			for i := 0; i < d.numPieces; i++ {
+				state.bitfield.SetPiece(i)
+			}
+			d.picker.PeerBitfield(state.bitfield)
+		}
+	case pmidRejectRequest:
+		req, err := parseBlockRequest(msg.payload)
+		if err != nil {
+			d.dropPeer(peerConn, err)
+			return
+		}
+		// Someone else (or this peer, once it unchokes us) can send it.
+		d.picker.Unrequest(peerConn, req)
+		d.requestFromAll()
+	case pmidAllowedFast, pmidSuggestPiece:
+		if len(msg.payload) != 4 {
+			d.dropPeer(peerConn, fmt.Errorf("Malformed msg with id %d: %x", msg.id, msg.payload))
+			return
+		}
+		pieceIndex := int(binary.BigEndian.Uint32(msg.payload))
+		if pieceIndex >= d.numPieces {
+			break
+		}
+		if msg.id == pmidAllowedFast {
+			state.allowedFast[pieceIndex] = true
+		} else {
+			state.suggested = append(state.suggested, pieceIndex)
+		}
+	case pmidExtended:
+		d.handleExtended(peerConn, state, msg)
+	case pmidRequest:
+		d.serveRequest(peerConn, state, msg)
+	case pmidPiece:
+		state.lastBlock = time.Now()
+		d.handleBlock(peerConn, msg)
+	}
+
+	// Handling the message may have dropped the peer.
+	if _, ok := d.peers[peerConn]; !ok {
+		return
+	}
+	d.updateInterest(peerConn, state)
+	d.requestBlocks(peerConn, state)
+}
+
+func (d *Downloader) handleExtended(peerConn *PeerConn, state *peerState, msg PeerMessage) {
+	if len(msg.payload) < 1 {
+		d.dropPeer(peerConn, fmt.Errorf("Empty extended msg"))
+		return
+	}
+
+	switch int(msg.payload[0]) {
+	case extendedHandshakeId:
+		hs, err := parseExtendedHandshake(msg.payload[1:])
+		if err != nil {
+			d.dropPeer(peerConn, err)
+			return
+		}
+		state.extensions = hs.extensions
+		state.listenPort = hs.listenPort
+		// Give the peer a head start with the peers we know right away, the
+		// next updates follow every pexInterval.
+		d.sendPexTo(peerConn, state, d.pexPeers())
+	case localExtensions["ut_pex"]:
+		d.handlePex(peerConn, msg.payload[1:])
+	}
+}
+
+func (d *Downloader) dropIdlePeers() {
+	for peerConn, state := range d.peers {
+		if d.picker.Outstanding(peerConn) > 0 && time.Since(state.lastBlock) > requestTimeout {
+			d.dropPeer(peerConn, fmt.Errorf("No blocks received for %v", requestTimeout))
+		}
+	}
+}
+
+func (d *Downloader) dropPeer(peerConn *PeerConn, err error) {
+	fmt.Printf("Dropping peer %s: %v\n", peerConn.Conn.RemoteAddr(), err)
+	d.removePeer(peerConn)
+}
+
+func (d *Downloader) updateInterest(peerConn *PeerConn, state *peerState) {
+	peerConn.SetInterested(d.picker.Interesting(state.bitfield))
+}
+
+func (d *Downloader) requestBlocks(peerConn *PeerConn, state *peerState) {
+	if !peerConn.Interested() {
+		return
+	}
+
+	// While choked, we may only ask for the pieces the peer allowed us.
+	candidates := state.bitfield
+	if peerConn.Choked() {
+		if len(state.allowedFast) == 0 {
+			return
+		}
+		candidates = d.maskBitfield(state.bitfield, state.allowedFast)
+	}
+
+	outstanding := d.picker.Outstanding(peerConn)
+	n := maxOutstandingRequests - outstanding
+	if n <= 0 {
+		return
+	}
+	if outstanding == 0 {
+		state.lastBlock = time.Now()
+	}
+
+	var reqs []blockRequest
+	if len(state.suggested) > 0 {
+		suggested := make(map[int]bool, len(state.suggested))
+		for _, pieceIndex := range state.suggested {
+			suggested[pieceIndex] = !d.picker.HasPiece(pieceIndex)
+		}
+		reqs = d.picker.Pick(peerConn, d.maskBitfield(candidates, suggested), n)
+	}
+	reqs = append(reqs, d.picker.Pick(peerConn, candidates, n-len(reqs))...)
+	for _, req := range reqs {
+		peerConn.Send(PeerMessage{pmidRequest, req.payload()})
+	}
+}
+
+// maskBitfield returns the pieces of bitfield that are also in pieces.
+func (d *Downloader) maskBitfield(bitfield Bitfield, pieces map[int]bool) Bitfield {
+	masked := NewBitfield(d.numPieces)
+	for pieceIndex, ok := range pieces {
+		if ok && bitfield.HasPiece(pieceIndex) {
+			masked.SetPiece(pieceIndex)
+		}
+	}
+	return masked
+}
+
+func (d *Downloader) requestFromAll() {
+	for peerConn, state := range d.peers {
+		d.requestBlocks(peerConn, state)
+	}
+}
+
+func (d *Downloader) handleBlock(peerConn *PeerConn, msg PeerMessage) {
+	if len(msg.payload) < 8 {
+		d.dropPeer(peerConn, fmt.Errorf("Malformed 'piece' msg: %x", msg.payload))
+		return
+	}
+	pieceIndex := int(binary.BigEndian.Uint32(msg.payload[0:4]))
+	blockBegin := int(binary.BigEndian.Uint32(msg.payload[4:8]))
+	blockData := msg.payload[8:]
+
+	pp, others := d.picker.BlockReceived(peerConn, pieceIndex, blockBegin, blockData)
+	for _, other := range others {
+		cancel := blockRequest{pieceIndex, blockBegin, len(blockData)}
+		other.Send(PeerMessage{pmidCancel, cancel.payload()})
+	}
+	if pp == nil {
+		return
+	}
+
+	// The piece is verified off the event loop, which gets the result back
+	// on d.hashed.
+	d.hashing++
+	info := &d.torr.info
+	data := pp.data
+	sources := pp.sources()
+	owner := pp.owner
+	Hashers.Go(func() {
+		res := hashResult{pieceIndex, data, sources, owner, info.checkPiece(pieceIndex, data)}
+		select {
+		case d.hashed <- res:
+		case <-d.done:
+		}
+	})
+}
+
+type hashResult struct {
+	pieceIndex int
+	data       []byte
+	sources    []*PeerConn // the peers that sent its blocks
+	owner      *PeerConn   // the peer it was downloaded from on parole, if any
+	err        error
+}
+
+func (d *Downloader) pieceHashed(res hashResult) {
+	pieceIndex := res.pieceIndex
+	if res.err != nil {
+		fmt.Printf("%v!\n", res.err)
+		d.picker.PieceFailed(pieceIndex)
+		d.blame(pieceIndex, res.sources, res.owner)
+		d.requestFromAll()
+		return
+	}
+	fmt.Printf("Piece %d matches expected hash! :)\n", pieceIndex)
+	if res.owner != nil {
+		d.acquit(res.owner)
+	}
+
+	if _, err := d.storage.WriteAt(res.data, pieceIndex, 0); err != nil {
+		d.err = err
+		return
+	}
+	if err := d.storage.MarkComplete(pieceIndex); err != nil {
+		d.err = err
+		return
+	}
+	d.picker.MarkDone(pieceIndex)
+	close(d.verified[pieceIndex])
+	for other, state := range d.peers {
+		other.Send(pieceIndexMessage(pmidHave, pieceIndex))
+		d.updateInterest(other, state)
+	}
+}
+
+func (d *Downloader) serveRequest(peerConn *PeerConn, state *peerState, msg PeerMessage) {
+	req, err := parseBlockRequest(msg.payload)
+	if err != nil {
+		d.dropPeer(peerConn, err)
+		return
+	}
+
+	// Requests we won't serve are ignored, or rejected with the Fast Extension.
+	reject := func() {
+		if peerConn.FastExtension() {
+			peerConn.Send(PeerMessage{pmidRejectRequest, msg.payload})
+		}
+	}
+	if peerConn.AmChoking() && !state.grantedFast[req.index] {
+		reject()
+		return
+	}
+	if req.index >= d.numPieces || !d.picker.HasPiece(req.index) {
+		reject()
+		return
+	}
+	if req.length <= 0 || req.length > maxServedBlockSize || req.begin+req.length > d.torr.info.pieceSize(req.index) {
+		reject()
+		return
+	}
+	block := make([]byte, req.length)
+	if _, err := d.storage.ReadAt(block, req.index, req.begin); err != nil {
+		fmt.Printf("%v\n", err)
+		reject()
+		return
+	}
+
+	peerConn.Send(pieceMessage(req.index, req.begin, block))
+}
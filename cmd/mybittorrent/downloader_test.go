@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// testSeeder is an in-process peer with some pieces of a torrent, which
+// serves every request for them. It has a peer ID of its own, as a Downloader
+// in the same process would share ours.
+type testSeeder struct {
+	torr     *torrent
+	infoHash []byte
+	data     []byte
+	has      func(pieceIndex int) bool
+	peerId   string
+}
+
+// startTestSeeder serves the seeder on a loopback port, and returns its
+// address.
+func startTestSeeder(t *testing.T, s *testSeeder) Peer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return Peer{Ip: addr.IP, Port: uint(addr.Port)}
+}
+
+func (s *testSeeder) serve(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	start, err := br.Peek(len(plaintextHandshakePrefix))
+	if err != nil {
+		return
+	}
+	if bytes.Equal(start, plaintextHandshakePrefix) {
+		conn = &mseConn{conn, br, conn}
+	} else {
+		conn, _, err = mseRespond(conn, br, [][]byte{s.infoHash}, mseCryptoRC4|mseCryptoPlaintext)
+		if err != nil {
+			return
+		}
+	}
+
+	hs, err := readHandshake(conn)
+	if err != nil || !bytes.Equal(hs.InfoHash, s.infoHash) {
+		return
+	}
+	reply := append([]byte("\x13BitTorrent protocol"), make([]byte, 8)...)
+	reply = append(reply, s.infoHash...)
+	reply = append(reply, s.peerId...)
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+
+	numPieces := s.torr.info.numPieces()
+	bitfield := NewBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		if s.has(i) {
+			bitfield.SetPiece(i)
+		}
+	}
+	if err := sendPeerMessage(conn, PeerMessage{pmidBitfield, bitfield}); err != nil {
+		return
+	}
+
+	for {
+		msg, err := readPeerMessage(conn)
+		if err != nil {
+			return
+		}
+		switch msg.id {
+		case pmidInterested:
+			err = sendPeerMessage(conn, PeerMessage{pmidUnchoke, []byte{}})
+		case pmidRequest:
+			if len(msg.payload) != 12 {
+				return
+			}
+			pieceIndex := int(binary.BigEndian.Uint32(msg.payload[0:4]))
+			begin := int(binary.BigEndian.Uint32(msg.payload[4:8]))
+			length := int(binary.BigEndian.Uint32(msg.payload[8:12]))
+			if pieceIndex >= numPieces || !s.has(pieceIndex) {
+				return
+			}
+			offset := pieceIndex*s.torr.info.pieceLength + begin
+			err = sendPeerMessage(conn, pieceMessage(pieceIndex, begin, s.data[offset:offset+length]))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestDownloadFromPeers(t *testing.T) {
+	tests := []struct {
+		name     string
+		numPeers int
+		// has reports whether the i-th peer has a piece.
+		has func(peer int, pieceIndex int) bool
+	}{
+		{"one seeder", 1, func(peer int, pieceIndex int) bool { return true }},
+		{"three seeders", 3, func(peer int, pieceIndex int) bool { return true }},
+		{"each peer missing a third", 3, func(peer int, pieceIndex int) bool { return pieceIndex%3 != peer }},
+	}
+	for _, tt := range tests {
+		has := tt.has
+		t.Run(tt.name, func(t *testing.T) {
+			torr, data := newTestTorrent(t, t.TempDir(), []int{300000, 45678, 1})
+			var peers []Peer
+			for i := 0; i < tt.numPeers; i++ {
+				i := i
+				peers = append(peers, startTestSeeder(t, &testSeeder{
+					torr:     torr,
+					infoHash: torr.infoHash,
+					data:     data,
+					has:      func(pieceIndex int) bool { return has(i, pieceIndex) },
+					peerId:   fmt.Sprintf("-TS0001-%012d", i),
+				}))
+			}
+
+			d := NewDownloader(torr, torr.infoHash)
+			d.SetStorage(NewMemoryStorage(&torr.info))
+			d.AddPeers(peers)
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			if err := d.Run(ctx); err != nil {
+				t.Fatalf("Failed to download: %v", err)
+			}
+
+			var got []byte
+			for i := 0; i < torr.info.numPieces(); i++ {
+				got = append(got, d.Piece(i)...)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("Downloaded data doesn't match")
+			}
+		})
+	}
+}
+
+func TestSeedAfterDownload(t *testing.T) {
+	torr, data := newTestTorrent(t, t.TempDir(), []int{100000})
+	storage := NewMemoryStorage(&torr.info)
+	d := NewDownloader(torr, torr.infoHash)
+	d.SetStorage(storage)
+	for i := 0; i < torr.info.numPieces(); i++ {
+		offset := i * torr.info.pieceLength
+		if _, err := storage.WriteAt(data[offset:offset+torr.info.pieceSize(i)], i, 0); err != nil {
+			t.Fatal(err)
+		}
+		d.SetVerified(i)
+	}
+	d.SetSeed(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	d.Listen(ctx, listener)
+	ran := make(chan error, 1)
+	go func() { ran <- d.Run(ctx) }()
+
+	select {
+	case <-d.Completed():
+	case <-time.After(10 * time.Second):
+		t.Fatal("The download didn't complete")
+	}
+
+	// A leecher connects, and is sent a block.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	hs := append([]byte("\x13BitTorrent protocol"), make([]byte, 8)...)
+	hs = append(hs, torr.infoHash...)
+	hs = append(hs, "-TS0001-leecher00000"...)
+	if _, err := conn.Write(hs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readHandshake(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendPeerMessage(conn, PeerMessage{pmidInterested, []byte{}}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := readPeerMessage(conn)
+		if err != nil {
+			t.Fatalf("Failed to read from the seed: %v", err)
+		}
+		if msg.id == pmidUnchoke {
+			request := blockRequest{1, 0, BlockSize}
+			if err := sendPeerMessage(conn, PeerMessage{pmidRequest, request.payload()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if msg.id == pmidPiece {
+			offset := torr.info.pieceLength
+			if !bytes.Equal(msg.payload[8:], data[offset:offset+BlockSize]) {
+				t.Fatalf("Got a block which doesn't match")
+			}
+			break
+		}
+	}
+
+	cancel()
+	if err := <-ran; err != nil {
+		t.Fatalf("Run returned %v, expected nil after seeding", err)
+	}
+}
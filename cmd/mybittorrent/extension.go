@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Extension protocol (BEP 10) messages all have id 20. The first payload byte
+// is 0 for the extended handshake, or else the id of the extension message,
+// as assigned by the receiving side in its extended handshake.
+const pmidExtended pmid = 20
+
+const extendedHandshakeId = 0
+
+// Extension messages we support, with the ids we assign to them.
+var localExtensions = map[string]int{
+	"ut_pex": 1,
+}
+
+type extendedHandshake struct {
+	// Ids the peer assigned to the extension messages it supports.
+	extensions map[string]int
+	listenPort int
+	client     string
+}
+
+// extendedHandshakeMessage advertises listenPort, unless it's 0 because we
+// don't accept incoming connections. Private torrents don't advertise ut_pex.
+func extendedHandshakeMessage(listenPort int, private bool) PeerMessage {
+	m := make(map[string]interface{}, len(localExtensions))
+	for name, id := range localExtensions {
+		if private && name == "ut_pex" {
+			continue
+		}
+		m[name] = id
+	}
+	dict := map[string]interface{}{
+		"m": m,
+		"v": "bittorrent-go 0.0.1",
+	}
+	if listenPort > 0 {
+		dict["p"] = listenPort
+	}
+	return extendedMessage(extendedHandshakeId, Bencode(dict))
+}
+
+func extendedMessage(extId int, bencoded string) PeerMessage {
+	payload := make([]byte, 0, 1+len(bencoded))
+	payload = append(payload, byte(extId))
+	payload = append(payload, bencoded...)
+	return PeerMessage{pmidExtended, payload}
+}
+
+func parseExtendedHandshake(payload []byte) (*extendedHandshake, error) {
+	decoded, err := DecodeBencode(string(payload))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected type in extended handshake. Expected dict.")
+	}
+
+	hs := &extendedHandshake{extensions: make(map[string]int)}
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, idVal := range m {
+			// An id of 0 means the extension was disabled.
+			if id, ok := idVal.(int); ok && id > 0 && id < 256 {
+				hs.extensions[name] = id
+			}
+		}
+	}
+	if port, ok := dict["p"].(int); ok && port > 0 && port < 65536 {
+		hs.listenPort = port
+	}
+	hs.client, _ = dict["v"].(string)
+
+	return hs, nil
+}
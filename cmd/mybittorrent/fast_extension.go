@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// Number of pieces we let each peer download while it's choked.
+const allowedFastSetSize = 10
+
+// allowedFastSet computes the canonical set of pieces that a peer at ip may
+// request while choked (BEP 6). It's derived from the peer's /24 network so
+// that a peer can't get more free pieces by reconnecting from other addresses.
+func allowedFastSet(ip net.IP, infoHash []byte, numPieces int, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash...)
+
+	set := make([]int, 0, k)
+	seen := make(map[int]bool, k)
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			y := binary.BigEndian.Uint32(x[i*4 : i*4+4])
+			pieceIndex := int(y % uint32(numPieces))
+			if !seen[pieceIndex] {
+				seen[pieceIndex] = true
+				set = append(set, pieceIndex)
+			}
+		}
+	}
+
+	return set
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Pieces after the one being read that are prioritized too, so a reader going
+// through a file rarely has to wait.
+const readaheadPieces = 4
+
+// FileReader reads a file of a torrent while it's being downloaded. A read
+// makes the pieces it needs urgent, and blocks until they are verified.
+type FileReader struct {
+	ctx    context.Context
+	d      *Downloader
+	start  int // of the file in the torrent
+	length int
+	pos    int
+}
+
+// OpenFile returns a reader for the file with index fileIndex, in the order of
+// the torrent's files. Reads fail once ctx is done, or the download stops
+// without the pieces they need.
+func (d *Downloader) OpenFile(ctx context.Context, fileIndex int) (*FileReader, error) {
+	files := d.torr.info.files
+	if fileIndex < 0 || fileIndex >= len(files) {
+		return nil, fmt.Errorf("Torrent has %d files, there is no file %d", len(files), fileIndex)
+	}
+	start := d.torr.info.fileOffset(fileIndex)
+	return &FileReader{ctx: ctx, d: d, start: start, length: files[fileIndex].length}, nil
+}
+
+func (r *FileReader) Read(b []byte) (int, error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	pieceLength := r.d.torr.info.pieceLength
+	offset := r.start + r.pos
+	pieceIndex := offset / pieceLength
+
+	lastPiece := (r.start + r.length - 1) / pieceLength
+	if pieceIndex+readaheadPieces < lastPiece {
+		lastPiece = pieceIndex + readaheadPieces
+	}
+	var missing []int
+	for i := pieceIndex; i <= lastPiece; i++ {
+		if !r.d.isVerified(i) {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 {
+		if err := r.d.requestPieces(r.ctx, missing); err != nil {
+			return 0, err
+		}
+	}
+	if err := r.d.waitPiece(r.ctx, pieceIndex); err != nil {
+		return 0, err
+	}
+
+	begin := offset - pieceIndex*pieceLength
+	if n := r.d.torr.info.pieceSize(pieceIndex) - begin; len(b) > n {
+		b = b[:n]
+	}
+	if n := r.length - r.pos; len(b) > n {
+		b = b[:n]
+	}
+	n, err := r.d.storage.ReadAt(b, pieceIndex, begin)
+	r.pos += n
+	return n, err
+}
+
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	pos := int(offset)
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += r.pos
+	case io.SeekEnd:
+		pos += r.length
+	default:
+		return 0, errors.New("FileReader.Seek: invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("FileReader.Seek: negative position")
+	}
+	r.pos = pos
+	return int64(pos), nil
+}
+
+func (d *Downloader) isVerified(pieceIndex int) bool {
+	select {
+	case <-d.verified[pieceIndex]:
+		return true
+	default:
+		return false
+	}
+}
+
+// requestPieces asks the event loop to download pieces before any others.
+func (d *Downloader) requestPieces(ctx context.Context, pieces []int) error {
+	select {
+	case d.priorities <- pieces:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.done:
+		return nil
+	}
+}
+
+func (d *Downloader) waitPiece(ctx context.Context, pieceIndex int) error {
+	select {
+	case <-d.verified[pieceIndex]:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.done:
+		if d.isVerified(pieceIndex) {
+			return nil
+		}
+		return fmt.Errorf("Download stopped before piece %d was verified", pieceIndex)
+	}
+}
+
+func (d *Downloader) prioritize(pieces []int) {
+	for _, pieceIndex := range pieces {
+		d.picker.Prioritize(pieceIndex)
+	}
+	for peerConn, state := range d.peers {
+		d.updateInterest(peerConn, state)
+	}
+	d.requestFromAll()
+}
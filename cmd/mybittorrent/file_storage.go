@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FileStorage keeps the pieces of a torrent in its files. A single-file
+// torrent is stored in one file, and a multi-file torrent in files under a
+// directory.
+type FileStorage struct {
+	info  *torrentInfo
+	files []*os.File
+}
+
+// NewFileStorage creates the files of torr at outPath, truncating any that
+// exist. If wanted isn't nil, only the files it selects are created, along
+// with those that share a piece with them. Those hold just their part of the
+// shared pieces, so the pieces can be read back, and aren't truncated. Padding
+// files are never created, and symlinks are created right away. Space for the
+// files is set aside as prealloc says.
+func NewFileStorage(torr *torrent, outPath string, wanted []bool, prealloc Prealloc) (*FileStorage, error) {
+	s := &FileStorage{info: &torr.info}
+	if err := s.create(outPath, wanted, "", prealloc, false); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// ResumeFileStorage is like NewFileStorage, but keeps the data of files that
+// exist, so the pieces already downloaded can be verified and kept.
+func ResumeFileStorage(torr *torrent, outPath string, wanted []bool, prealloc Prealloc) (*FileStorage, error) {
+	s := &FileStorage{info: &torr.info}
+	if err := s.create(outPath, wanted, "", prealloc, true); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenFileStorage opens the files of torr at outPath read-only, e.g. to verify
+// them. Files that don't exist are left out, so reading from them fails.
+func OpenFileStorage(torr *torrent, outPath string) (*FileStorage, error) {
+	s := &FileStorage{info: &torr.info}
+	for _, file := range torr.info.files {
+		if file.padding || file.symlink != nil {
+			s.files = append(s.files, nil)
+			continue
+		}
+		f, err := os.Open(filePath(&torr.info, outPath, file.path))
+		if os.IsNotExist(err) {
+			s.files = append(s.files, nil)
+			continue
+		}
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+	}
+	return s, nil
+}
+
+// create creates the files, with suffix appended to their paths. Unless keep
+// is set, files that exist are truncated.
+func (s *FileStorage) create(outPath string, wanted []bool, suffix string, prealloc Prealloc, keep bool) error {
+	boundary := boundaryBytes(s.info, wanted)
+	stored := func(i int) bool {
+		file := s.info.files[i]
+		return !file.padding && file.symlink == nil && (wanted == nil || wanted[i] || boundary[i] > 0)
+	}
+	// The download needs the space sooner or later, whether or not it is
+	// preallocated, so it fails early if there isn't enough.
+	var size int64
+	for i, file := range s.info.files {
+		if !stored(i) {
+			continue
+		}
+		if boundary[i] > 0 {
+			size += int64(boundary[i])
+			continue
+		}
+		size += int64(file.length)
+		// Space the file takes already is either reused or freed.
+		if stat, err := os.Stat(filePath(s.info, outPath, file.path) + suffix); err == nil {
+			existing := stat.Size()
+			if existing > int64(file.length) {
+				existing = int64(file.length)
+			}
+			size -= existing
+		}
+	}
+	if err := checkDiskSpace(outPath, size); err != nil {
+		return err
+	}
+
+	for i, file := range s.info.files {
+		if !stored(i) {
+			s.files = append(s.files, nil)
+			continue
+		}
+		path := filePath(s.info, outPath, file.path) + suffix
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		flags := os.O_RDWR | os.O_CREATE
+		if !keep && boundary[i] == 0 {
+			flags |= os.O_TRUNC
+		}
+		f, err := os.OpenFile(path, flags, 0666)
+		if err != nil {
+			return err
+		}
+		s.files = append(s.files, f)
+		// On Unix a file is hidden by its name, so the hidden attribute needs
+		// nothing more.
+		if file.executable {
+			if err := f.Chmod(0755); err != nil {
+				return err
+			}
+		}
+		if boundary[i] > 0 {
+			continue
+		}
+		if err := preallocFile(f, int64(file.length), prealloc); err != nil {
+			return err
+		}
+	}
+
+	for i, file := range s.info.files {
+		if file.symlink == nil || (wanted != nil && !wanted[i]) {
+			continue
+		}
+		if err := createSymlink(s.info, outPath, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boundaryPieces returns the pieces that each file that isn't wanted shares
+// with a wanted file. Only a file's first and last pieces can be shared.
+func boundaryPieces(info *torrentInfo, wanted []bool) [][]int {
+	boundary := make([][]int, len(info.files))
+	if wanted == nil {
+		return boundary
+	}
+	wantedPieces := make(map[int]bool)
+	for i, file := range info.files {
+		if !wanted[i] || file.padding {
+			continue
+		}
+		first, last := info.filePieces(i)
+		if first <= last {
+			wantedPieces[first] = true
+			wantedPieces[last] = true
+		}
+	}
+
+	for i, file := range info.files {
+		if wanted[i] || file.padding || file.symlink != nil {
+			continue
+		}
+		first, last := info.filePieces(i)
+		if first > last {
+			continue
+		}
+		if wantedPieces[first] {
+			boundary[i] = append(boundary[i], first)
+		}
+		if last != first && wantedPieces[last] {
+			boundary[i] = append(boundary[i], last)
+		}
+	}
+	return boundary
+}
+
+// boundaryBytes returns how many bytes each file that isn't wanted has in
+// pieces shared with a wanted file.
+func boundaryBytes(info *torrentInfo, wanted []bool) []int {
+	boundary := make([]int, len(info.files))
+	for i, pieces := range boundaryPieces(info, wanted) {
+		start, end := info.fileOffset(i), info.fileOffset(i)+info.files[i].length
+		for _, pieceIndex := range pieces {
+			pieceStart, pieceEnd := pieceIndex*info.pieceLength, (pieceIndex+1)*info.pieceLength
+			if pieceStart < start {
+				pieceStart = start
+			}
+			if pieceEnd > end {
+				pieceEnd = end
+			}
+			boundary[i] += pieceEnd - pieceStart
+		}
+	}
+	return boundary
+}
+
+// filePath is where a file of the torrent goes, for output at outPath.
+func filePath(info *torrentInfo, outPath string, path []string) string {
+	if !info.multiFile {
+		return outPath
+	}
+	return filepath.Join(append([]string{outPath}, path...)...)
+}
+
+// createSymlink links a file to its target, with a relative path, as both are
+// in the torrent.
+func createSymlink(info *torrentInfo, outPath string, file torrentFile) error {
+	root := outPath
+	if !info.multiFile {
+		root = filepath.Dir(outPath)
+	}
+	link := filePath(info, outPath, file.path)
+	target := filepath.Join(append([]string{root}, file.symlink...)...)
+	relTarget, err := filepath.Rel(filepath.Dir(link), target)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	// Like files, links from an earlier download are replaced.
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(relTarget, link)
+}
+
+// ReadAt reads from the files a piece overlaps. Padding reads as zeros, and
+// reading from a file that wasn't created fails.
+func (s *FileStorage) ReadAt(b []byte, pieceIndex int, offset int) (int, error) {
+	n := 0
+	for _, segment := range s.info.fileSegments(pieceIndex*s.info.pieceLength+offset, len(b)) {
+		part := b[n : n+segment.length]
+		f := s.files[segment.file]
+		switch {
+		case s.info.files[segment.file].padding:
+			for i := range part {
+				part[i] = 0
+			}
+		case f == nil:
+			return n, fmt.Errorf("Failed to read piece %d: file %d isn't stored", pieceIndex, segment.file)
+		default:
+			if _, err := f.ReadAt(part, int64(segment.offset)); err != nil {
+				return n, fmt.Errorf("Failed to read piece %d: %v", pieceIndex, err)
+			}
+		}
+		n += segment.length
+	}
+	return n, nil
+}
+
+// WriteAt writes to the files a piece overlaps, skipping padding and the files
+// that weren't created.
+func (s *FileStorage) WriteAt(b []byte, pieceIndex int, offset int) (int, error) {
+	n := 0
+	for _, segment := range s.info.fileSegments(pieceIndex*s.info.pieceLength+offset, len(b)) {
+		if f := s.files[segment.file]; f != nil {
+			if _, err := f.WriteAt(b[n:n+segment.length], int64(segment.offset)); err != nil {
+				return n, fmt.Errorf("Failed to write piece %d: %v", pieceIndex, err)
+			}
+		}
+		n += segment.length
+	}
+	return n, nil
+}
+
+func (s *FileStorage) MarkComplete(pieceIndex int) error {
+	return nil
+}
+
+// Sync commits the files to disk.
+func (s *FileStorage) Sync() error {
+	for _, f := range s.files {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the files. Closing again does nothing.
+func (s *FileStorage) Close() error {
+	var firstErr error
+	for i, f := range s.files {
+		if f == nil {
+			continue
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.files[i] = nil
+	}
+	return firstErr
+}
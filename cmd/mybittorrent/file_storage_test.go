@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoundaryBytes(t *testing.T) {
+	// With 32 KiB pieces, file 1 spans pieces 1 to 4, sharing piece 1 with
+	// file 0 and piece 4 with file 2.
+	info := &torrentInfo{
+		pieceLength: testPieceLength,
+		length:      190000,
+		files:       []torrentFile{{length: 40000}, {length: 100000}, {length: 50000}},
+	}
+	tests := []struct {
+		wanted   []bool
+		expected []int
+	}{
+		{nil, []int{0, 0, 0}},
+		{[]bool{true, true, true}, []int{0, 0, 0}},
+		{[]bool{true, false, true}, []int{0, 65536 - 40000 + 140000 - 131072, 0}},
+		{[]bool{true, false, false}, []int{0, 65536 - 40000, 0}},
+		{[]bool{false, true, false}, []int{40000 - 32768, 0, 163840 - 140000}},
+	}
+	for _, tt := range tests {
+		got := boundaryBytes(info, tt.wanted)
+		if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+			t.Errorf("boundaryBytes(%v) = %v, expected %v", tt.wanted, got, tt.expected)
+		}
+	}
+}
+
+func TestFileStorageResumeBoundaryPieces(t *testing.T) {
+	dir := t.TempDir()
+	torr, data := newTestTorrent(t, dir, []int{40000, 100000, 50000})
+	outPath := filepath.Join(dir, "out")
+	wanted := []bool{true, false, true}
+
+	storage, err := NewFileStorage(torr, outPath, wanted, PreallocNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantedPieces := []int{0, 1, 4, 5}
+	for _, pieceIndex := range wantedPieces {
+		offset := pieceIndex * torr.info.pieceLength
+		piece := data[offset : offset+torr.info.pieceSize(pieceIndex)]
+		if _, err := storage.WriteAt(piece, pieceIndex, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = ResumeFileStorage(torr, outPath, wanted, PreallocNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	verified := Hashers.VerifyPieces(&torr.info, storage)
+	expected := []bool{true, true, false, false, true, true}
+	if fmt.Sprint(verified) != fmt.Sprint(expected) {
+		t.Fatalf("Verified pieces %v, expected %v", verified, expected)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ftpFetchRange downloads length bytes at offset of the file at an ftp://
+// URL, in passive binary mode, waiting for limits as they arrive. It's only
+// as much FTP as web seeds need.
+func ftpFetchRange(ctx context.Context, fileURL string, offset int, length int, limits rateLimiters) ([]byte, error) {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "21")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webSeedRequestTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stopWatching := watchConn(ctx, conn, webSeedRequestTimeout)
+	defer stopWatching()
+
+	tp := textproto.NewConn(conn)
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		return nil, err
+	}
+
+	user, password := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	code, _, err := ftpCommand(tp, "USER "+user)
+	if err != nil {
+		return nil, err
+	}
+	if code == 331 {
+		if code, msg, err := ftpCommand(tp, "PASS "+password); err != nil {
+			return nil, err
+		} else if code != 230 && code != 202 {
+			return nil, fmt.Errorf("FTP login failed: %d %s", code, msg)
+		}
+	} else if code != 230 {
+		return nil, fmt.Errorf("FTP login failed with code %d", code)
+	}
+
+	if code, msg, err := ftpCommand(tp, "TYPE I"); err != nil {
+		return nil, err
+	} else if code != 200 {
+		return nil, fmt.Errorf("FTP TYPE I failed: %d %s", code, msg)
+	}
+
+	dataAddr, err := ftpPassive(tp, conn)
+	if err != nil {
+		return nil, err
+	}
+	dataConn, err := dialer.DialContext(ctx, "tcp", dataAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer dataConn.Close()
+	stopWatchingData := watchConn(ctx, dataConn, webSeedRequestTimeout)
+	defer stopWatchingData()
+
+	if offset > 0 {
+		if code, msg, err := ftpCommand(tp, fmt.Sprintf("REST %d", offset)); err != nil {
+			return nil, err
+		} else if code != 350 {
+			return nil, fmt.Errorf("FTP REST failed: %d %s", code, msg)
+		}
+	}
+	if code, msg, err := ftpCommand(tp, "RETR "+u.Path); err != nil {
+		return nil, err
+	} else if code != 125 && code != 150 {
+		return nil, fmt.Errorf("FTP RETR failed: %d %s", code, msg)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(rateLimitedReader{dataConn, limits, ctx.Done()}, data); err != nil {
+		return nil, err
+	}
+	// We usually stop before the end of the file, so don't wait for the
+	// transfer to complete.
+	ftpCommand(tp, "QUIT")
+
+	return data, nil
+}
+
+func ftpCommand(tp *textproto.Conn, command string) (int, string, error) {
+	if err := tp.PrintfLine("%s", command); err != nil {
+		return 0, "", err
+	}
+	code, msg, err := tp.ReadResponse(0)
+	if _, ok := err.(*textproto.Error); ok {
+		// Unexpected codes are up to the caller.
+		err = nil
+	}
+	return code, msg, err
+}
+
+// ftpPassive asks for a data connection address, with EPSV and then PASV.
+func ftpPassive(tp *textproto.Conn, conn net.Conn) (string, error) {
+	controlHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	code, msg, err := ftpCommand(tp, "EPSV")
+	if err != nil {
+		return "", err
+	}
+	if code == 229 {
+		// "Entering Extended Passive Mode (|||port|)"
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start >= 0 && end > start+4 {
+			if port, err := strconv.Atoi(msg[start+4 : end]); err == nil {
+				return net.JoinHostPort(controlHost, strconv.Itoa(port)), nil
+			}
+		}
+	}
+
+	code, msg, err = ftpCommand(tp, "PASV")
+	if err != nil {
+		return "", err
+	}
+	if code != 227 {
+		return "", fmt.Errorf("FTP PASV failed: %d %s", code, msg)
+	}
+	// "Entering Passive Mode (h1,h2,h3,h4,p1,p2)"
+	start, end := strings.Index(msg, "("), strings.Index(msg, ")")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("Malformed PASV response: %s", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return "", fmt.Errorf("Malformed PASV response: %s", msg)
+	}
+	p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return "", fmt.Errorf("Malformed PASV response: %s", msg)
+	}
+	// The host in the response is often wrong behind NAT, so use the one we
+	// connected to.
+	return net.JoinHostPort(controlHost, strconv.Itoa(p1*256+p2)), nil
+}
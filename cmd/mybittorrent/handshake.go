@@ -1,20 +1,68 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 )
 
-func handshake(conn net.Conn, infoHash []byte, extension bool) ([]byte, error) {
+var errConnectedToSelf = errors.New("connected to ourselves")
+
+// Handshake is the parsed handshake message of a peer.
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash []byte
+	PeerId   []byte
+}
+
+// SupportsExtensions reports whether the peer supports the extension
+// protocol (BEP 10).
+func (hs *Handshake) SupportsExtensions() bool {
+	return hs.Reserved[5]&0x10 != 0
+}
+
+// SupportsFast reports whether the peer supports the Fast Extension (BEP 6).
+// We always advertise it, so it's in use whenever the peer supports it.
+func (hs *Handshake) SupportsFast() bool {
+	return hs.Reserved[7]&0x04 != 0
+}
+
+// validate checks that the peer is in the swarm of infoHash, and that we
+// didn't just connect to ourselves, e.g. through a NAT that maps our public
+// address back to us.
+func (hs *Handshake) validate(infoHash []byte) error {
+	if !bytes.Equal(hs.InfoHash, infoHash) {
+		return fmt.Errorf("Peer handshake has info hash %x, expected %x", hs.InfoHash, infoHash)
+	}
+	if string(hs.PeerId) == PeerId {
+		return errConnectedToSelf
+	}
+	return nil
+}
+
+func handshake(ctx context.Context, conn net.Conn, infoHash []byte, extension bool) (*Handshake, error) {
+	stopWatching := watchConn(ctx, conn, handshakeTimeout)
+	defer stopWatching()
+
 	err := writeHandshake(conn, infoHash, extension)
 	if err != nil {
-		return []byte{}, err
+		return nil, err
 	}
 
-	peerId, err := readHandshake(conn)
-	return peerId, err
+	peerHandshake, err := readHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	err = peerHandshake.validate(infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return peerHandshake, nil
 }
 
 func writeHandshake(conn net.Conn, infoHash []byte, extension bool) error {
@@ -25,6 +73,7 @@ func writeHandshake(conn net.Conn, infoHash []byte, extension bool) error {
 	if extension {
 		binary.BigEndian.PutUint64(extensionsBytes, uint64(1)<<20)
 	}
+	extensionsBytes[7] |= 0x04 // Fast Extension
 	hs = append(hs, extensionsBytes...)
 	hs = append(hs, infoHash...)
 	hs = append(hs, []byte(PeerId)...)
@@ -37,7 +86,7 @@ func writeHandshake(conn net.Conn, infoHash []byte, extension bool) error {
 	return err
 }
 
-func readHandshake(conn net.Conn) ([]byte, error) {
+func readHandshake(conn net.Conn) (*Handshake, error) {
 	handshakeResp := make([]byte, 68)
 	n, err := io.ReadFull(conn, handshakeResp)
 	if err != nil && err != io.EOF {
@@ -51,7 +100,12 @@ func readHandshake(conn net.Conn) ([]byte, error) {
 		err = fmt.Errorf("Malformed handshake response!")
 		return nil, err
 	}
-	peerId := handshakeResp[48:68]
 
-	return peerId, nil
+	peerHandshake := &Handshake{
+		InfoHash: handshakeResp[28:48],
+		PeerId:   handshakeResp[48:68],
+	}
+	copy(peerHandshake.Reserved[:], handshakeResp[20:28])
+
+	return peerHandshake, nil
 }
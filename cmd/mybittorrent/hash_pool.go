@@ -0,0 +1,89 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Hashers verifies pieces for downloads, resumes and the verify and create
+// commands, on one goroutine per CPU.
+var Hashers = NewHashPool(runtime.NumCPU())
+
+// HashPool runs hashing jobs on a fixed number of goroutines. Jobs are queued
+// without bound, so submitting one never blocks, e.g. the download's event
+// loop while the pool is busy reporting back to it.
+type HashPool struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []func()
+	closed bool
+}
+
+func NewHashPool(workers int) *HashPool {
+	p := &HashPool{}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Go runs job on one of the pool's goroutines.
+func (p *HashPool) Go(job func()) {
+	p.mu.Lock()
+	p.queue = append(p.queue, job)
+	p.mu.Unlock()
+	p.cond.Signal()
+}
+
+// Close stops the pool once the jobs already queued are done.
+func (p *HashPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+func (p *HashPool) work() {
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		job := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		job()
+	}
+}
+
+// VerifyPieces reports which pieces of the torrent storage holds and match
+// their hashes. Pieces are read one at a time and hashed in parallel, with at
+// most a couple per CPU waiting, to bound the memory used.
+func (p *HashPool) VerifyPieces(info *torrentInfo, storage Storage) []bool {
+	valid := make([]bool, info.numPieces())
+	inFlight := make(chan struct{}, 2*runtime.NumCPU())
+	var wg sync.WaitGroup
+	for pieceIndex := range valid {
+		data := make([]byte, info.pieceSize(pieceIndex))
+		if _, err := storage.ReadAt(data, pieceIndex, 0); err != nil {
+			continue
+		}
+		inFlight <- struct{}{}
+		wg.Add(1)
+		pieceIndex := pieceIndex
+		p.Go(func() {
+			defer wg.Done()
+			valid[pieceIndex] = info.checkPiece(pieceIndex, data) == nil
+			<-inFlight
+		})
+	}
+	wg.Wait()
+	return valid
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPieceLength = 32 * 1024
+
+// newTestTorrent writes files of the given sizes, with random contents, to a
+// "content" directory under dir, and makes a torrent of them. It returns the
+// torrent and the contents of its files, one after the other.
+func newTestTorrent(t *testing.T, dir string, sizes []int) (*torrent, []byte) {
+	t.Helper()
+	root := filepath.Join(dir, "content")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(int64(len(sizes))))
+	var data []byte
+	var files []interface{}
+	for i, size := range sizes {
+		contents := make([]byte, size)
+		r.Read(contents)
+		data = append(data, contents...)
+		name := fmt.Sprintf("file%d.bin", i)
+		if err := os.WriteFile(filepath.Join(root, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, map[string]interface{}{
+			"length": size,
+			"path":   []interface{}{name},
+		})
+	}
+
+	var pieces []byte
+	for offset := 0; offset < len(data); offset += testPieceLength {
+		end := offset + testPieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[offset:end])
+		pieces = append(pieces, hash[:]...)
+	}
+	bencoded := Bencode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "content",
+			"piece length": testPieceLength,
+			"pieces":       string(pieces),
+			"files":        files,
+		},
+	})
+	torrFilepath := filepath.Join(dir, "test.torrent")
+	if err := os.WriteFile(torrFilepath, []byte(bencoded), 0644); err != nil {
+		t.Fatal(err)
+	}
+	torr, _, err := ParseTorrent(torrFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torr, data
+}
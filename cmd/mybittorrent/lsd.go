@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lsdAnnounceInterval = 5 * time.Minute
+	lsdMaxPacketSize    = 1400
+)
+
+// Multicast groups of Local Service Discovery (BEP 14).
+var (
+	lsdGroup4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	lsdGroup6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+type lsdSocket struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+}
+
+// LSD finds peers on the local network, by multicasting announcements of the
+// torrents we're in and listening for the announcements of others.
+type LSD struct {
+	sockets []lsdSocket
+	// Identifies our own announcements, which we also receive.
+	cookie string
+
+	mu       sync.Mutex
+	torrents map[string]func([]Peer) // by hex info hash
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// StartLSD joins the IPv4 and IPv6 LSD groups. It fails only if it can join
+// neither.
+func StartLSD() (*LSD, error) {
+	l := &LSD{
+		cookie:   hex.EncodeToString([]byte(NewPeerId()[len(peerIdPrefix):])),
+		torrents: make(map[string]func([]Peer)),
+		closed:   make(chan struct{}),
+	}
+
+	var errs []string
+	for _, group := range []*net.UDPAddr{lsdGroup4, lsdGroup6} {
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+		conn, err := net.ListenMulticastUDP(network, nil, group)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		l.sockets = append(l.sockets, lsdSocket{conn, group})
+	}
+	if len(l.sockets) == 0 {
+		return nil, fmt.Errorf("Failed to join the LSD multicast groups: %s", strings.Join(errs, "; "))
+	}
+
+	for _, socket := range l.sockets {
+		go l.readLoop(socket.conn)
+	}
+
+	return l, nil
+}
+
+func (l *LSD) Close() {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		for _, socket := range l.sockets {
+			socket.conn.Close()
+		}
+	})
+}
+
+// Register passes the peers announced for infoHash to onPeers, until the
+// returned function is called.
+func (l *LSD) Register(infoHash []byte, onPeers func([]Peer)) func() {
+	key := hex.EncodeToString(infoHash)
+	l.mu.Lock()
+	l.torrents[key] = onPeers
+	l.mu.Unlock()
+
+	return func() {
+		l.mu.Lock()
+		delete(l.torrents, key)
+		l.mu.Unlock()
+	}
+}
+
+// Announce tells the local network that we accept connections for the
+// torrents with infoHashes on port.
+func (l *LSD) Announce(infoHashes [][]byte, port int) error {
+	var lastErr error
+	sent := false
+	for _, socket := range l.sockets {
+		host := socket.group.String()
+		// Several info hashes fit in one packet.
+		for start := 0; start < len(infoHashes); {
+			msg, n := lsdAnnouncement(host, port, infoHashes[start:], l.cookie)
+			start += n
+			if _, err := socket.conn.WriteToUDP([]byte(msg), socket.group); err != nil {
+				lastErr = err
+				continue
+			}
+			sent = true
+		}
+	}
+	if !sent {
+		return lastErr
+	}
+	return nil
+}
+
+// lsdAnnouncement builds an announcement for as many of infoHashes as fit in
+// a packet, and returns it with how many it included.
+func lsdAnnouncement(host string, port int, infoHashes [][]byte, cookie string) (string, int) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", host, port)
+	n := 0
+	for _, infoHash := range infoHashes {
+		line := fmt.Sprintf("Infohash: %s\r\n", hex.EncodeToString(infoHash))
+		if n > 0 && sb.Len()+len(line)+len(cookie)+16 > lsdMaxPacketSize {
+			break
+		}
+		sb.WriteString(line)
+		n++
+	}
+	fmt.Fprintf(&sb, "cookie: %s\r\n\r\n\r\n", cookie)
+	return sb.String(), n
+}
+
+func (l *LSD) readLoop(conn *net.UDPConn) {
+	buf := make([]byte, lsdMaxPacketSize*2)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return
+		}
+		l.handlePacket(string(buf[:n]), addr)
+	}
+}
+
+func (l *LSD) handlePacket(packet string, addr *net.UDPAddr) {
+	port, infoHashes, cookie, err := parseLsdAnnouncement(packet)
+	if err != nil || cookie == l.cookie {
+		return
+	}
+	peer := Peer{Ip: addr.IP, Port: uint(port)}
+
+	for _, infoHash := range infoHashes {
+		l.mu.Lock()
+		onPeers, ok := l.torrents[strings.ToLower(infoHash)]
+		l.mu.Unlock()
+		if ok {
+			onPeers([]Peer{peer})
+		}
+	}
+}
+
+func parseLsdAnnouncement(packet string) (port int, infoHashes []string, cookie string, err error) {
+	lines := strings.Split(packet, "\r\n")
+	if !strings.HasPrefix(lines[0], "BT-SEARCH * HTTP/1.") {
+		return 0, nil, "", fmt.Errorf("Not an LSD announcement")
+	}
+
+	for _, line := range lines[1:] {
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[colon+1:])
+		switch strings.ToLower(line[:colon]) {
+		case "port":
+			port, err = strconv.Atoi(value)
+			if err != nil || port <= 0 || port > 65535 {
+				return 0, nil, "", fmt.Errorf("Invalid port in LSD announcement: %s", value)
+			}
+		case "infohash":
+			if len(value) == 40 {
+				infoHashes = append(infoHashes, value)
+			}
+		case "cookie":
+			cookie = value
+		}
+	}
+	if port == 0 || len(infoHashes) == 0 {
+		return 0, nil, "", fmt.Errorf("Incomplete LSD announcement")
+	}
+
+	return port, infoHashes, cookie, nil
+}
+
+// UseLSD makes the downloader find peers on the local network, and announce
+// itself there if it's listening. It must be called before Run.
+func (d *Downloader) UseLSD(lsd *LSD) {
+	// Private torrents (BEP 27) must not be announced on the local network.
+	if d.torr.info.private {
+		return
+	}
+	d.lsd = lsd
+}
+
+func (d *Downloader) announceLSD(ctx context.Context) {
+	unregister := d.lsd.Register(d.infoHash, func(peers []Peer) {
+		fmt.Printf("Found peer %s on the local network\n", peers[0].Addr())
+		d.AddPeers(peers)
+	})
+	defer unregister()
+	if d.listenPort == 0 {
+		<-ctx.Done()
+		return
+	}
+
+	ticker := time.NewTicker(lsdAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		if err := d.lsd.Announce([][]byte{d.infoHash}, d.listenPort); err != nil {
+			fmt.Printf("LSD announce failed: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet holds the parameters of a magnet URI.
+type Magnet struct {
+	InfoHash []byte // btih, nil if there is only a v2 info hash
+	// The SHA-256 info hash of a v2 torrent, from btmh (BEP 52).
+	InfoHashV2 []byte
+	Name       string   // dn
+	Length     int      // xl, 0 if unknown
+	Trackers   []string // tr
+	WebSeeds   []string // ws
+	Peers      []Peer   // x.pe
+}
+
+func ParseMagnet(magnetURI string) (*Magnet, error) {
+	u, err := url.Parse(magnetURI)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("Expected URI scheme to be 'magnet'. Got %s", u.Scheme)
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+		WebSeeds: q["ws"],
+	}
+	for _, xt := range q["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			m.InfoHash, err = parseBtih(strings.TrimPrefix(xt, "urn:btih:"))
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			m.InfoHashV2, err = parseBtmh(strings.TrimPrefix(xt, "urn:btmh:"))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m.InfoHash == nil && m.InfoHashV2 == nil {
+		return nil, fmt.Errorf("Expected param xt to start with 'urn:btih:' or 'urn:btmh:' - got %q", q["xt"])
+	}
+
+	if xl := q.Get("xl"); xl != "" {
+		m.Length, err = strconv.Atoi(xl)
+		if err != nil || m.Length < 0 {
+			return nil, fmt.Errorf("Invalid exact length %q", xl)
+		}
+	}
+	for _, pe := range q["x.pe"] {
+		peer, err := parsePeerAddr(pe)
+		if err != nil {
+			return nil, err
+		}
+		m.Peers = append(m.Peers, peer)
+	}
+
+	return m, nil
+}
+
+// parseBtih decodes a v1 info hash, which is either 40 hex digits or 32
+// base32 characters.
+func parseBtih(btih string) ([]byte, error) {
+	switch len(btih) {
+	case 40:
+		infoHash, err := hex.DecodeString(btih)
+		if err == nil {
+			return infoHash, nil
+		}
+	case 32:
+		infoHash, err := base32.StdEncoding.DecodeString(strings.ToUpper(btih))
+		if err == nil {
+			return infoHash, nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid info hash %q. Expected 40 hex digits or 32 base32 characters.", btih)
+}
+
+// parseBtmh decodes a v2 info hash, which is the hex multihash of a SHA-256
+// hash: 0x12, the length 0x20 and the hash.
+func parseBtmh(btmh string) ([]byte, error) {
+	multihash, err := hex.DecodeString(btmh)
+	if err != nil || len(multihash) != 34 || multihash[0] != 0x12 || multihash[1] != 0x20 {
+		return nil, fmt.Errorf("Invalid v2 info hash %q. Expected a SHA-256 multihash.", btmh)
+	}
+	return multihash[2:], nil
+}
+
+func parsePeerAddr(addr string) (Peer, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Peer{}, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port > 65535 {
+		return Peer{}, fmt.Errorf("Invalid peer address %q", addr)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// A host name.
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return Peer{}, err
+		}
+		ip = tcpAddr.IP
+	}
+	return Peer{Ip: ip, Port: uint(port)}, nil
+}
+
+// MagnetURI returns a magnet URI for the torrent, with its name, length,
+// trackers and web seeds.
+func (torr *torrent) MagnetURI() string {
+	var params []string
+	if torr.info.pieces != nil {
+		params = append(params, fmt.Sprintf("xt=urn:btih:%x", torr.infoHash))
+	}
+	if torr.infoHashV2 != nil {
+		params = append(params, fmt.Sprintf("xt=urn:btmh:1220%x", torr.infoHashV2))
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "magnet:?%s", strings.Join(params, "&"))
+	fmt.Fprintf(&sb, "&dn=%s", magnetEscape(torr.info.name))
+	fmt.Fprintf(&sb, "&xl=%d", torr.info.contentLength())
+	// Magnet URIs have no tiers, so the trackers of all of them are listed in
+	// order.
+	for _, tier := range torr.Trackers() {
+		for _, tracker := range tier {
+			fmt.Fprintf(&sb, "&tr=%s", magnetEscape(tracker))
+		}
+	}
+	for _, seedURL := range torr.urlList {
+		fmt.Fprintf(&sb, "&ws=%s", magnetEscape(seedURL))
+	}
+	return sb.String()
+}
+
+// magnetEscape escapes a query value, with spaces as %20 rather than '+',
+// which not every client decodes.
+func magnetEscape(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMagnetURILengthWithoutPadding(t *testing.T) {
+	torr := &torrent{
+		info: torrentInfo{
+			name:        "content",
+			length:      testPieceLength + 500,
+			pieceLength: testPieceLength,
+			files: []torrentFile{
+				{length: 1000, path: []string{"a"}},
+				{length: testPieceLength - 1000, path: []string{".pad", "31768"}, padding: true},
+				{length: 500, path: []string{"b"}},
+			},
+			multiFile: true,
+		},
+		infoHashV2: make([]byte, 32),
+	}
+	uri := torr.MagnetURI()
+	if !strings.Contains(uri, "&xl=1500") {
+		t.Fatalf("Got %s, expected xl=1500", uri)
+	}
+	if got := torr.info.contentLength(); got != 1500 {
+		t.Fatalf("Got content length %d, expected 1500", got)
+	}
+}
+
+func TestMagnetURITrackers(t *testing.T) {
+	torr := &torrent{
+		announce:     "http://a/announce",
+		announceList: [][]string{{"http://b/announce", "http://c/announce"}, {"http://b/announce", "http://d/announce"}},
+		info:         torrentInfo{name: "content", length: 1000, pieceLength: testPieceLength, pieces: []string{""}},
+		infoHash:     make([]byte, 20),
+	}
+	// The trackers are those announces go to, tier after tier.
+	expected := "&tr=http%3A%2F%2Fb%2Fannounce&tr=http%3A%2F%2Fc%2Fannounce&tr=http%3A%2F%2Fd%2Fannounce"
+	if uri := torr.MagnetURI(); !strings.HasSuffix(uri, expected) {
+		t.Fatalf("Got %s, expected it to end with %s", uri, expected)
+	}
+}
@@ -1,18 +1,24 @@
 package main
 
 import (
-	"crypto/sha1"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"net"
-	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
-const PeerId = "c20e54494e34aa21c2af"
+// ListenPort is the port we accept peer connections on, and announce to trackers.
+const ListenPort = 6881
+
+const stoppedAnnounceTimeout = 5 * time.Second
 
 func panicIf(err error) {
 	if err != nil {
@@ -20,9 +26,113 @@ func panicIf(err error) {
 	}
 }
 
+// exitIfInterrupted shuts down cleanly after SIGINT/SIGTERM, closing the
+// storage, if any, so what was downloaded is flushed to disk, and telling the
+// tracker that we left the swarm.
+func exitIfInterrupted(ctx context.Context, trackers *TrackerTiers, infoHash []byte, storage Storage) {
+	if ctx.Err() == nil {
+		return
+	}
+	if storage != nil {
+		if err := storage.Close(); err != nil {
+			fmt.Printf("Failed to close the storage: %v\n", err)
+		}
+	}
+	announceStopped(trackers, infoHash)
+	fmt.Println("Interrupted, shutting down.")
+	os.Exit(130)
+}
+
+// announceStopped gets its own timeout, as it usually runs after the main
+// context has been cancelled.
+func announceStopped(trackers *TrackerTiers, infoHash []byte) {
+	if trackers.Empty() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+	defer cancel()
+	_, err := trackers.Announce(ctx, infoHash, TrackerEventStopped)
+	if err != nil {
+		fmt.Printf("Failed to announce 'stopped' to the tracker: %v\n", err)
+	}
+}
+
+// stringsFlag collects the values of a flag that can be given several times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// selectFiles works out the priority of each file, from --only selectors and
+// --priority settings like high=0,3 or skip=*.iso.
+func selectFiles(info *torrentInfo, only []string, priorities []string) ([]Priority, error) {
+	filePriorities := make([]Priority, len(info.files))
+	for i, file := range info.files {
+		if file.padding || len(only) > 0 {
+			filePriorities[i] = PrioritySkip
+		} else {
+			filePriorities[i] = PriorityNormal
+		}
+	}
+
+	for _, selectors := range only {
+		files, err := info.matchFiles(strings.Split(selectors, ","))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if !info.files[file].padding {
+				filePriorities[file] = PriorityNormal
+			}
+		}
+	}
+
+	for _, setting := range priorities {
+		eq := strings.IndexByte(setting, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("Expected <level>=<files> in --priority, got %q", setting)
+		}
+		priority, err := ParsePriority(setting[:eq])
+		if err != nil {
+			return nil, err
+		}
+		files, err := info.matchFiles(strings.Split(setting[eq+1:], ","))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if !info.files[file].padding {
+				filePriorities[file] = priority
+			}
+		}
+	}
+
+	return filePriorities, nil
+}
+
 func main() {
 	command := os.Args[1]
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if peerIdFile := os.Getenv(PeerIdFileEnv); peerIdFile != "" {
+		var err error
+		PeerId, err = LoadOrCreatePeerId(peerIdFile)
+		panicIf(err)
+	}
+	if mode := os.Getenv(EncryptionModeEnv); mode != "" {
+		var err error
+		Encryption, err = ParseEncryptionMode(mode)
+		panicIf(err)
+	}
+
 	switch command {
 	case "decode":
 		bencodedValue := os.Args[2]
@@ -36,21 +146,56 @@ func main() {
 		t, infoHash, err := ParseTorrent(os.Args[2])
 		panicIf(err)
 		fmt.Printf("Tracker URL: %s\n", t.announce)
-		fmt.Printf("Length: %d\n", t.info.length)
+		fmt.Printf("Length: %d\n", t.info.contentLength())
 		fmt.Printf("Info Hash: %x\n", infoHash)
+		if t.infoHashV2 != nil {
+			fmt.Printf("Info Hash v2: %x\n", t.infoHashV2)
+		}
 		fmt.Printf("Piece Length: %d\n", t.info.pieceLength)
+		if t.info.private {
+			fmt.Println("Private: yes")
+		}
 		fmt.Println("Piece Hashes:")
 		for _, p := range t.info.pieces {
 			fmt.Printf("%x\n", p)
 		}
+		if t.info.pieces == nil {
+			for _, p := range t.info.piecesV2 {
+				fmt.Printf("%x\n", p.root)
+			}
+		}
+		if t.info.multiFile {
+			fmt.Println("Files:")
+			for i, file := range t.info.files {
+				if file.padding {
+					continue
+				}
+				path := strings.Join(file.path, "/")
+				switch {
+				case file.symlink != nil:
+					fmt.Printf("%d: %s -> %s\n", i, path, strings.Join(file.symlink, "/"))
+				case file.executable:
+					fmt.Printf("%d: %s (%d bytes, executable)\n", i, path, file.length)
+				default:
+					fmt.Printf("%d: %s (%d bytes)\n", i, path, file.length)
+				}
+			}
+		}
 	case "peers":
 		torrFile := os.Args[2]
 		torr, infoHash, err := ParseTorrent(torrFile)
 		panicIf(err)
-		trackerResp, err := TrackerRequest(torr.announce, infoHash, PeerId)
+		trackerResp, err := NewTrackerTiers(torr).Announce(ctx, infoHash, TrackerEventNone)
 		panicIf(err)
+		// Trackers send compact peer lists, without peer IDs, so the clients
+		// are told by their handshakes.
+		IdentifyPeers(ctx, trackerResp.Peers, infoHash)
 		for _, peer := range trackerResp.Peers {
-			fmt.Printf("%s:%d\n", peer.Ip, peer.Port)
+			if peer.Id != nil {
+				fmt.Printf("%s:%d (%s)\n", peer.Ip, peer.Port, ClientName(peer.Id))
+			} else {
+				fmt.Printf("%s:%d\n", peer.Ip, peer.Port)
+			}
 		}
 	case "handshake":
 		torrName := os.Args[2]
@@ -59,16 +204,13 @@ func main() {
 		_, infoHash, err := ParseTorrent(torrName)
 		panicIf(err)
 
-		conn, err := net.Dial("tcp", peerIpPort)
+		conn, err := dialPeer(ctx, peerIpPort)
 		panicIf(err)
 		defer conn.Close()
 
-		err = writeHandshake(conn, infoHash, false)
-		panicIf(err)
-
-		peerId, err := readHandshake(conn)
+		peerHandshake, err := handshake(ctx, conn, infoHash, false)
 		panicIf(err)
-		fmt.Printf("Peer ID: %x\n", peerId)
+		fmt.Printf("Peer ID: %x\n", peerHandshake.PeerId)
 	case "download_piece":
 		usageString := fmt.Sprintf("Usage: %s download_piece -o <output-filepath> <torrent-filepath> <piece-number>", os.Args[0])
 		if len(os.Args) < 6 || os.Args[2] != "-o" {
@@ -83,205 +225,348 @@ func main() {
 		torr, infoHash, err := ParseTorrent(torrFilepath)
 		panicIf(err)
 
-		numPieces := len(torr.info.pieces)
+		numPieces := torr.info.numPieces()
 		if pieceIndex < 0 || pieceIndex >= numPieces {
 			panic(fmt.Sprintf("Torrent %s has %d pieces, so <piece-number> can be between 0 and %d", torrFilepath, numPieces, numPieces-1))
 		}
 
-		trackerResp, err := TrackerRequest(torr.announce, infoHash, PeerId)
-		panicIf(err)
-
-		peer := trackerResp.Peers[0]
-		peerConn, bitfield, err := ConnectToPeer(peer, infoHash, false)
-		defer peerConn.Close()
+		trackers := NewTrackerTiers(torr)
+		trackerResp, err := trackers.Announce(ctx, infoHash, TrackerEventStarted)
 		panicIf(err)
 
-		if !bitfield.HasPiece(pieceIndex) {
-			panic(fmt.Sprintf("Peer %#v does NOT have piece %d\n", peer, pieceIndex))
-		}
-
-		torrLength := torr.info.length
-		pieceLength := torr.info.pieceLength
-		if pieceIndex == numPieces-1 {
-			// last piece may be shorter than the others
-			pieceLength = torrLength % pieceLength
+		downloader := NewDownloader(torr, infoHash)
+		for i := 0; i < numPieces; i++ {
+			downloader.SetWanted(i, i == pieceIndex)
 		}
-
-		piece, err := DownloadPiece(&peerConn, pieceIndex, pieceLength)
+		downloader.AddPeers(trackerResp.Peers)
+		err = downloader.Run(ctx)
+		exitIfInterrupted(ctx, trackers, infoHash, nil)
 		panicIf(err)
-
-		pieceHashArray := sha1.Sum(piece)
-		pieceHash := string(pieceHashArray[:])
-		expectedHash := torr.info.pieces[pieceIndex]
-		if pieceHash[:] != expectedHash {
-			panic(fmt.Errorf("Got piece %d with hash %x which differs from expected hash %x!\n",
-				pieceIndex, pieceHash, expectedHash))
-		} else {
-			fmt.Printf("Piece %d matches expected hash %x! :)\n", pieceIndex, expectedHash)
-		}
+		announceStopped(trackers, infoHash)
 
 		outFile, err := os.Create(outFilepath)
 		panicIf(err)
 		defer outFile.Close()
 		fmt.Printf("Opened file %s to write piece %d.\n", outFilepath, pieceIndex)
 
-		_, err = outFile.Write(piece)
+		_, err = outFile.Write(downloader.Piece(pieceIndex))
 		panicIf(err)
 		fmt.Printf("Piece %d downloaded to %s.\n", pieceIndex, outFilepath)
 	case "download":
-		usageString := fmt.Sprintf("Usage: %s download -o <output-filepath> <torrent-filepath>", os.Args[0])
-		if len(os.Args) < 5 || os.Args[2] != "-o" {
+		usageString := fmt.Sprintf("Usage: %s download [--sequential] [--seed] [--resume] [--part] [--prealloc <none|sparse|full>] [--cache <MiB>] [--fsync <never|close|piece>] [--max-download <rate>] [--max-upload <rate>] [--max-peer-download <rate>] [--max-peer-upload <rate>] [--schedule <HH:MM-HH:MM=down/up>]... [--only <files>] [--priority <level>=<files>] -o <output-path> <torrent-filepath>", os.Args[0])
+		flags := flag.NewFlagSet("download", flag.ExitOnError)
+		outFlag := flags.String("o", "", "output file, or directory of a multi-file torrent")
+		sequential := flags.Bool("sequential", false, "download the pieces in order, so the output can be read while downloading")
+		seed := flags.Bool("seed", false, "keep uploading to peers after the download, until interrupted")
+		resume := flags.Bool("resume", false, "keep the pieces already in the output that verify, and download the rest")
+		part := flags.Bool("part", false, "write files with a .part suffix, renamed once each is complete")
+		preallocFlag := flags.String("prealloc", "none", "set aside space for the files: none, sparse or full")
+		cacheFlag := flags.Int("cache", DefaultCacheSize/(1024*1024), "MiB of pieces to cache in memory, 0 to write and read the files directly")
+		fsyncFlag := flags.String("fsync", "close", "when the cache syncs the files to disk: never, close or piece")
+		maxDownload := flags.String("max-download", "0", "limit the download rate, in bytes per second like 500K or 2M, 0 for no limit")
+		maxUpload := flags.String("max-upload", "0", "limit the upload rate, in bytes per second like 500K or 2M, 0 for no limit")
+		maxPeerDownload := flags.String("max-peer-download", "0", "limit the download rate from each peer")
+		maxPeerUpload := flags.String("max-peer-upload", "0", "limit the upload rate to each peer")
+		var only, priorities, schedule stringsFlag
+		flags.Var(&schedule, "schedule", "use other rate limits during a time of day, like 22:00-07:00=0/0, can be given several times")
+		flags.Var(&only, "only", "download only these files: indices or globs, comma-separated")
+		flags.Var(&priorities, "priority", "set the priority of files, as <skip|low|normal|high>=<files>")
+		flags.Parse(os.Args[2:])
+		if *outFlag == "" || flags.NArg() < 1 {
 			panic(usageString)
 		}
 
-		outFilepath := os.Args[3]
-		torrFilepath := os.Args[4]
+		outFilepath := *outFlag
+		torrFilepath := flags.Arg(0)
 
 		torr, infoHash, err := ParseTorrent(torrFilepath)
 		panicIf(err)
 
-		trackerResp, err := TrackerRequest(torr.announce, infoHash, PeerId)
+		prealloc, err := ParsePrealloc(*preallocFlag)
 		panicIf(err)
-
-		peer := trackerResp.Peers[0]
-		peerConn, bitfield, err := ConnectToPeer(peer, infoHash, false)
-		defer peerConn.Close()
+		fsync, err := ParseFsyncPolicy(*fsyncFlag)
+		panicIf(err)
+		rateSchedule := &RateSchedule{}
+		rateSchedule.Download, err = ParseRate(*maxDownload)
+		panicIf(err)
+		rateSchedule.Upload, err = ParseRate(*maxUpload)
+		panicIf(err)
+		peerDownloadRate, err := ParseRate(*maxPeerDownload)
+		panicIf(err)
+		peerUploadRate, err := ParseRate(*maxPeerUpload)
 		panicIf(err)
+		for _, rule := range schedule {
+			r, err := ParseScheduleRule(rule)
+			panicIf(err)
+			rateSchedule.Rules = append(rateSchedule.Rules, r)
+		}
+		filePriorities, err := selectFiles(&torr.info, only, priorities)
+		panicIf(err)
+		wanted := make([]bool, len(filePriorities))
+		for i, priority := range filePriorities {
+			wanted[i] = priority != PrioritySkip
+		}
 
-		numPieces := len(torr.info.pieces)
-		pieces := make([]Piece, 0, numPieces)
-		for pieceIndex := 0; pieceIndex < numPieces; pieceIndex++ {
-			if !bitfield.HasPiece(pieceIndex) {
-				panic(fmt.Sprintf("Peer %#v does NOT have piece %d\n", peer, pieceIndex))
+		// Pieces are written as soon as they are verified.
+		var storage Storage
+		switch {
+		case *resume && *part:
+			storage, err = ResumePartStorage(torr, outFilepath, wanted, prealloc)
+		case *resume:
+			storage, err = ResumeFileStorage(torr, outFilepath, wanted, prealloc)
+		case *part:
+			storage, err = NewPartStorage(torr, outFilepath, wanted, prealloc)
+		default:
+			storage, err = NewFileStorage(torr, outFilepath, wanted, prealloc)
+		}
+		panicIf(err)
+		var verified []bool
+		if *resume {
+			verified = Hashers.VerifyPieces(&torr.info, storage)
+			// A part store renames the files whose pieces all verified.
+			for i, ok := range verified {
+				if ok {
+					panicIf(storage.MarkComplete(i))
+				}
 			}
+		}
+		if *cacheFlag > 0 {
+			storage = NewCachedStorage(storage, &torr.info, *cacheFlag*1024*1024, fsync)
+		}
+		defer storage.Close()
+		fmt.Printf("Opened %s to write torrent.\n", outFilepath)
 
-			torrLength := torr.info.length
-			pieceLength := torr.info.pieceLength
-			if pieceIndex == numPieces-1 {
-				// last piece may be shorter than the others
-				pieceLength = torrLength % pieceLength
+		downloader := NewDownloader(torr, infoHash)
+		for i, priority := range filePriorities {
+			downloader.SetFilePriority(i, priority)
+		}
+		downloader.SetStorage(storage)
+		// This is the only torrent, so the global limits are its own.
+		downloader.SetRateLimits(0, 0, peerDownloadRate, peerUploadRate)
+		go rateSchedule.Run(ctx, GlobalDownloadLimit, GlobalUploadLimit)
+		if *resume {
+			numVerified := 0
+			for i, ok := range verified {
+				if ok {
+					downloader.SetVerified(i)
+					numVerified++
+				}
 			}
-
-			piece, err := DownloadPiece(&peerConn, pieceIndex, pieceLength)
+			fmt.Printf("Resuming with %d of %d pieces already downloaded.\n", numVerified, len(verified))
+		}
+		downloader.SetSequential(*sequential)
+		downloader.SetSeed(*seed)
+		// Torrents with web seeds may have no tracker.
+		trackers := NewTrackerTiers(torr)
+		if !trackers.Empty() {
+			trackerResp, err := trackers.Announce(ctx, infoHash, TrackerEventStarted)
 			panicIf(err)
-
-			pieceHashArray := sha1.Sum(piece)
-			pieceHash := string(pieceHashArray[:])
-			expectedHash := torr.info.pieces[pieceIndex]
-			if pieceHash[:] != expectedHash {
-				panic(fmt.Errorf("Got piece %d with hash %x which differs from expected hash %x!\n",
-					pieceIndex, pieceHash, expectedHash))
+			downloader.AddPeers(trackerResp.Peers)
+		}
+		for _, seedURL := range torr.urlList {
+			downloader.AddWebSeed(seedURL)
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", ListenPort))
+		if err != nil {
+			fmt.Printf("Not accepting incoming connections: %v\n", err)
+		} else {
+			defer listener.Close()
+			downloader.Listen(ctx, listener)
+		}
+		// The DHT and uTP share a UDP socket on the same port.
+		udp, err := ListenUDP(ListenPort)
+		if err != nil {
+			fmt.Printf("Not using the DHT or uTP: %v\n", err)
+		} else {
+			defer udp.Close()
+			UTP = udp.UTP()
+			downloader.Listen(ctx, udp.UTP())
+		}
+		if torr.info.private {
+			fmt.Println("Private torrent, not using the DHT, PEX or LSD.")
+		} else {
+			if udp != nil {
+				dht, err := StartDHT(ctx, udp.DHTConn())
+				if err != nil {
+					fmt.Printf("Not using the DHT: %v\n", err)
+				} else {
+					defer dht.Close()
+					downloader.UseDHT(dht)
+				}
+			}
+			lsd, err := StartLSD()
+			if err != nil {
+				fmt.Printf("Not using LSD: %v\n", err)
 			} else {
-				fmt.Printf("Piece %d matches expected hash %x! :)\n", pieceIndex, expectedHash)
+				defer lsd.Close()
+				downloader.UseLSD(lsd)
 			}
-
-			pieces = append(pieces, piece)
 		}
-
-		outFile, err := os.Create(outFilepath)
+		announceCompleted := func() {
+			_, err := trackers.Announce(ctx, infoHash, TrackerEventCompleted)
+			if err != nil {
+				fmt.Printf("Failed to announce 'completed' to the tracker: %v\n", err)
+			}
+		}
+		if *seed && !trackers.Empty() {
+			// While seeding, Run returns only once interrupted.
+			go func() {
+				select {
+				case <-downloader.Completed():
+					announceCompleted()
+				case <-ctx.Done():
+				}
+			}()
+		}
+		err = downloader.Run(ctx)
+		select {
+		case <-downloader.Completed():
+		default:
+			exitIfInterrupted(ctx, trackers, infoHash, storage)
+		}
 		panicIf(err)
-		defer outFile.Close()
-		fmt.Printf("Opened file %s to write torrent.\n", outFilepath)
 
-		for pieceIndex, piece := range pieces {
-			n, err := outFile.Write(piece)
-			panicIf(err)
-			fmt.Printf("- Wrote piece %d, %d bytes.\n", pieceIndex, n)
+		if !trackers.Empty() {
+			if !*seed {
+				announceCompleted()
+			}
+			announceStopped(trackers, infoHash)
 		}
 
+		panicIf(storage.Close())
 		fmt.Printf("Downloaded %s to %s.\n", torrFilepath, outFilepath)
-	case "magnet_parse":
-		usageString := fmt.Sprintf("Usage: %s magnet_parse <magnet-uri>", os.Args[0])
-		if len(os.Args) < 3 {
+	case "verify":
+		usageString := fmt.Sprintf("Usage: %s verify <torrent-filepath> <path>", os.Args[0])
+		if len(os.Args) < 4 {
 			panic(usageString)
 		}
 
-		magnetURI := os.Args[2]
-		u, err := url.Parse(magnetURI)
+		torr, _, err := ParseTorrent(os.Args[2])
 		panicIf(err)
-		if u.Scheme != "magnet" {
-			panic(fmt.Errorf("Error: Expected URI scheme to be 'magnet'. Got %s\n", u.Scheme))
-		}
-
-		q, err := url.ParseQuery(u.RawQuery)
+		storage, err := OpenFileStorage(torr, os.Args[3])
 		panicIf(err)
+		defer storage.Close()
 
-		xt := q["xt"]
-		if len(xt) < 1 {
-			panic("Expected param xt to have at least one value")
+		verified := Hashers.VerifyPieces(&torr.info, storage)
+		numVerified := 0
+		for i, ok := range verified {
+			if ok {
+				numVerified++
+			} else {
+				fmt.Printf("Piece %d is missing or corrupt.\n", i)
+			}
 		}
-
-		xtVals := strings.Split(xt[0], ":")
-		if len(xtVals) < 3 || xtVals[0] != "urn" || xtVals[1] != "btih" {
-			panic(fmt.Errorf("Expected param xt to start with 'urn:btih:' - got %s\n", xt[0]))
+		fmt.Printf("%d of %d pieces verified.\n", numVerified, len(verified))
+		if numVerified < len(verified) {
+			storage.Close()
+			os.Exit(1)
 		}
-
-		tr := q["tr"]
-		if len(tr) < 1 {
-			panic("Expected param tr to have at least one value")
+	case "create":
+		usageString := fmt.Sprintf("Usage: %s create [--private] [--piece-length <bytes>] [--tracker <url>]... [--web-seed <url>]... -o <torrent-filepath> <path>", os.Args[0])
+		flags := flag.NewFlagSet("create", flag.ExitOnError)
+		outFlag := flags.String("o", "", "torrent file to write")
+		private := flags.Bool("private", false, "make a private torrent, whose peers come only from its trackers")
+		pieceLength := flags.Int("piece-length", 0, "piece length, a power of two (default: picked from the size)")
+		var trackers, webSeeds stringsFlag
+		flags.Var(&trackers, "tracker", "tracker announce URL, can be given several times")
+		flags.Var(&webSeeds, "web-seed", "web seed URL, can be given several times")
+		flags.Parse(os.Args[2:])
+		if *outFlag == "" || flags.NArg() < 1 {
+			panic(usageString)
 		}
 
-		infoHash := xtVals[2]
-		trackerURL := tr[0]
+		torrContent, err := CreateTorrent(flags.Arg(0), CreateOptions{
+			PieceLength: *pieceLength,
+			Trackers:    trackers,
+			WebSeeds:    webSeeds,
+			Private:     *private,
+		})
+		panicIf(err)
+		panicIf(os.WriteFile(*outFlag, []byte(torrContent), 0644))
 
-		fmt.Printf("Tracker URL: %s\nInfo Hash: %s\n", trackerURL, infoHash)
-	case "magnet_handshake":
-		usageString := fmt.Sprintf("Usage: %s magnet_handshake <magnet-uri>", os.Args[0])
+		torr, _, err := ParseTorrent(*outFlag)
+		panicIf(err)
+		fmt.Printf("Created %s.\n", *outFlag)
+		fmt.Println(torr.MagnetURI())
+	case "magnet":
+		usageString := fmt.Sprintf("Usage: %s magnet <torrent-filepath>", os.Args[0])
 		if len(os.Args) < 3 {
 			panic(usageString)
 		}
 
-		magnetURI := os.Args[2]
-		u, err := url.Parse(magnetURI)
+		torr, _, err := ParseTorrent(os.Args[2])
 		panicIf(err)
-		if u.Scheme != "magnet" {
-			panic(fmt.Errorf("Error: Expected URI scheme to be 'magnet'. Got %s\n", u.Scheme))
+		fmt.Println(torr.MagnetURI())
+	case "magnet_parse":
+		usageString := fmt.Sprintf("Usage: %s magnet_parse <magnet-uri>", os.Args[0])
+		if len(os.Args) < 3 {
+			panic(usageString)
 		}
 
-		q, err := url.ParseQuery(u.RawQuery)
+		magnet, err := ParseMagnet(os.Args[2])
 		panicIf(err)
 
-		xt := q["xt"]
-		if len(xt) < 1 {
-			panic("Expected param xt to have at least one value")
+		// Without a tracker, peers can be found on the DHT.
+		if len(magnet.Trackers) > 0 {
+			fmt.Printf("Tracker URL: %s\n", magnet.Trackers[0])
 		}
-
-		xtVals := strings.Split(xt[0], ":")
-		if len(xtVals) < 3 || xtVals[0] != "urn" || xtVals[1] != "btih" {
-			panic(fmt.Errorf("Expected param xt to start with 'urn:btih:' - got %s\n", xt[0]))
+		if magnet.InfoHash != nil {
+			fmt.Printf("Info Hash: %x\n", magnet.InfoHash)
 		}
-
-		tr := q["tr"]
-		if len(tr) < 1 {
-			panic("Expected param tr to have at least one value")
+		if magnet.InfoHashV2 != nil {
+			fmt.Printf("Info Hash v2: %x\n", magnet.InfoHashV2)
+		}
+	case "magnet_handshake":
+		usageString := fmt.Sprintf("Usage: %s magnet_handshake <magnet-uri>", os.Args[0])
+		if len(os.Args) < 3 {
+			panic(usageString)
 		}
 
-		infoHash := xtVals[2]
-		trackerURL := tr[0]
-
-		infoHashDecoded, err := hex.DecodeString(infoHash)
-		panicIf(err)
-		trackerResp, err := TrackerRequest(trackerURL, infoHashDecoded, PeerId)
+		magnet, err := ParseMagnet(os.Args[2])
 		panicIf(err)
+		infoHash := magnet.InfoHash
+		if infoHash == nil {
+			// v2 peers take the SHA-256 info hash truncated to 20 bytes in
+			// the handshake, and from trackers and the DHT.
+			infoHash = magnet.InfoHashV2[:20]
+		}
 
-		if len(trackerResp.Peers) < 1 {
-			panic("Expected at least one peer in tracker response")
+		// Peers in the magnet URI come first, then the ones of the trackers,
+		// and the DHT if there are no trackers.
+		peers := magnet.Peers
+		for _, tr := range magnet.Trackers {
+			trackerResp, err := TrackerRequest(ctx, tr, infoHash, PeerId, TrackerEventNone)
+			if err != nil {
+				fmt.Printf("Tracker %s failed: %v\n", tr, err)
+				continue
+			}
+			peers = append(peers, trackerResp.Peers...)
+		}
+		if len(magnet.Trackers) == 0 {
+			udp, err := ListenUDP(ListenPort)
+			panicIf(err)
+			defer udp.Close()
+			dht, err := StartDHT(ctx, udp.DHTConn())
+			panicIf(err)
+			defer dht.Close()
+			dhtPeers, err := dht.GetPeers(ctx, infoHash, 0)
+			panicIf(err)
+			peers = append(peers, dhtPeers...)
 		}
-		peer := trackerResp.Peers[0]
 
-		// for _, peer := range trackerResp.Peers {
-		// 	fmt.Printf("%s:%d\n", peer.Ip, peer.Port)
-		// }
+		if len(peers) < 1 {
+			panic("Expected to find at least one peer")
+		}
+		peer := peers[0]
 
-		peerIpPort := fmt.Sprintf("%s:%d", peer.Ip, peer.Port)
-		conn, err := net.Dial("tcp", peerIpPort)
+		conn, err := dialPeer(ctx, peer.Addr())
 		panicIf(err)
 		defer conn.Close()
 
-		peerId, err := handshake(conn, infoHashDecoded, true)
+		peerHandshake, err := handshake(ctx, conn, infoHash, true)
 		panicIf(err)
 
-		fmt.Printf("Peer ID: %s\n", hex.EncodeToString(peerId))
+		fmt.Printf("Peer ID: %s\n", hex.EncodeToString(peerHandshake.PeerId))
 	default:
 		fmt.Println("Unknown command: " + command)
 		os.Exit(1)
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSelectFiles(t *testing.T) {
+	info := &torrentInfo{
+		files: []torrentFile{
+			{length: 10, path: []string{"docs", "readme.txt"}},
+			{length: 10, path: []string{"video", "movie.mkv"}},
+			{length: 10, path: []string{"video", "extra.mkv"}},
+			{length: 10, path: []string{"disk.iso"}},
+		},
+		multiFile: true,
+	}
+	skip, low, normal, high := PrioritySkip, PriorityLow, PriorityNormal, PriorityHigh
+	tests := []struct {
+		only       []string
+		priorities []string
+		expected   []Priority
+	}{
+		{nil, nil, []Priority{normal, normal, normal, normal}},
+		{[]string{"1"}, nil, []Priority{skip, normal, skip, skip}},
+		{[]string{"docs/*", "3"}, nil, []Priority{normal, skip, skip, normal}},
+		{[]string{"video/*"}, []string{"high=1"}, []Priority{skip, high, normal, skip}},
+		{nil, []string{"skip=*.iso", "low=0,video/extra.mkv"}, []Priority{low, normal, low, skip}},
+	}
+	for _, tt := range tests {
+		got, err := selectFiles(info, tt.only, tt.priorities)
+		if err != nil {
+			t.Errorf("selectFiles(%q, %q) failed: %v", tt.only, tt.priorities, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+			t.Errorf("selectFiles(%q, %q) = %v, expected %v", tt.only, tt.priorities, got, tt.expected)
+		}
+	}
+
+	bad := []struct {
+		only       []string
+		priorities []string
+	}{
+		{[]string{"4"}, nil},
+		{[]string{"*.zip"}, nil},
+		{nil, []string{"high"}},
+		{nil, []string{"urgent=0"}},
+	}
+	for _, tt := range bad {
+		if _, err := selectFiles(info, tt.only, tt.priorities); err == nil {
+			t.Errorf("selectFiles(%q, %q) didn't fail", tt.only, tt.priorities)
+		}
+	}
+}
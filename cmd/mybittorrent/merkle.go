@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+)
+
+// In v2 torrents (BEP 52) each file has a merkle tree of SHA-256 hashes, whose
+// leaves are the hashes of its 16 KiB blocks. The tree is padded with zero
+// leaves up to a power of two.
+const merkleBlockSize = 16 * 1024
+
+// pieceHashV2 is what a piece of a v2 torrent is verified against: the root of
+// the merkle subtree over its blocks.
+type pieceHashV2 struct {
+	root string
+	// Bytes of the piece that belong to the file, the rest is padding.
+	length int
+	// Leaves of the subtree, including the padding.
+	leaves int
+}
+
+var merkleZeroLeaf = make([]byte, sha256.Size)
+
+// merkleRoot computes the root of a merkle tree over hashes, padded to width
+// (a power of two) with pad.
+func merkleRoot(hashes [][]byte, width int, pad []byte) []byte {
+	layer := make([][]byte, width)
+	for i := range layer {
+		if i < len(hashes) {
+			layer[i] = hashes[i]
+		} else {
+			layer[i] = pad
+		}
+	}
+
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for i := range next {
+			h := sha256.New()
+			h.Write(layer[2*i])
+			h.Write(layer[2*i+1])
+			next[i] = h.Sum(nil)
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+func merkleBlockHashes(data []byte) [][]byte {
+	var hashes [][]byte
+	for len(data) > 0 {
+		n := merkleBlockSize
+		if n > len(data) {
+			n = len(data)
+		}
+		hash := sha256.Sum256(data[:n])
+		hashes = append(hashes, hash[:])
+		data = data[n:]
+	}
+	return hashes
+}
+
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// checkPiece verifies a downloaded piece against the SHA-1 hash of v1
+// torrents, and the merkle tree of v2 ones. Hybrid torrents have to match
+// both.
+func (info *torrentInfo) checkPiece(pieceIndex int, data []byte) error {
+	if info.pieces != nil {
+		hash := sha1.Sum(data)
+		if expected := info.pieces[pieceIndex]; string(hash[:]) != expected {
+			return fmt.Errorf("Got piece %d with hash %x which differs from expected hash %x", pieceIndex, hash, expected)
+		}
+	}
+
+	if info.piecesV2 != nil {
+		expected := info.piecesV2[pieceIndex]
+		root := merkleRoot(merkleBlockHashes(data[:expected.length]), expected.leaves, merkleZeroLeaf)
+		if string(root) != expected.root {
+			return fmt.Errorf("Got piece %d with merkle root %x which differs from expected root %x", pieceIndex, root, expected.root)
+		}
+	}
+
+	// Padding is all zeros, whether or not the hashes cover it.
+	pos := 0
+	for _, segment := range info.fileSegments(pieceIndex*info.pieceLength, len(data)) {
+		if info.files[segment.file].padding {
+			for _, b := range data[pos : pos+segment.length] {
+				if b != 0 {
+					return fmt.Errorf("Got piece %d with non-zero padding", pieceIndex)
+				}
+			}
+		}
+		pos += segment.length
+	}
+
+	return nil
+}
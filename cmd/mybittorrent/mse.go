@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+)
+
+type EncryptionMode int
+
+const (
+	// Try Message Stream Encryption first, and fall back to plaintext.
+	EncryptionPrefer EncryptionMode = iota
+	// Only use encrypted connections.
+	EncryptionRequire
+	// Only use plaintext connections.
+	EncryptionDisable
+)
+
+// EncryptionModeEnv names an env var selecting the encryption mode: prefer
+// (the default), require or disable.
+const EncryptionModeEnv = "BITTORRENT_ENCRYPTION"
+
+// Encryption is the encryption mode of all peer connections.
+var Encryption = EncryptionPrefer
+
+func ParseEncryptionMode(mode string) (EncryptionMode, error) {
+	switch strings.ToLower(mode) {
+	case "prefer":
+		return EncryptionPrefer, nil
+	case "require":
+		return EncryptionRequire, nil
+	case "disable":
+		return EncryptionDisable, nil
+	}
+	return 0, fmt.Errorf("Unknown encryption mode %q. Expected prefer, require or disable.", mode)
+}
+
+// Methods in crypto_provide and crypto_select.
+const (
+	mseCryptoPlaintext = 0x01
+	mseCryptoRC4       = 0x02
+)
+
+const (
+	mseKeySize    = 96
+	mseMaxPadSize = 512
+	mseRC4Discard = 1024
+)
+
+var (
+	// The 768-bit Diffie-Hellman prime of MSE, with generator 2.
+	mseP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG    = big.NewInt(2)
+
+	// Verification constant.
+	mseVC = make([]byte, 8)
+
+	errEncryptionHandshake = errors.New("encryption handshake failed")
+
+	plaintextHandshakePrefix = []byte("\x13BitTorrent protocol")
+)
+
+// mseProvide is what we offer, or accept, under the current encryption mode.
+func mseProvide() uint32 {
+	if Encryption == EncryptionRequire {
+		return mseCryptoRC4
+	}
+	return mseCryptoRC4 | mseCryptoPlaintext
+}
+
+// mseConn is a connection after the encryption handshake. Reads and writes go
+// through the RC4 streams if that was selected, and reads first return any
+// data the handshake read ahead.
+type mseConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *mseConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *mseConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func newMseConn(conn net.Conn, br *bufio.Reader, initialPayload []byte, selected uint32, encrypt, decrypt *rc4.Cipher) *mseConn {
+	if selected == mseCryptoPlaintext {
+		return &mseConn{conn, io.MultiReader(bytes.NewReader(initialPayload), br), conn}
+	}
+	return &mseConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(initialPayload), cipherReader{decrypt, br}),
+		w:    cipherWriter{encrypt, conn},
+	}
+}
+
+type cipherReader struct {
+	c *rc4.Cipher
+	r io.Reader
+}
+
+func (c cipherReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.c.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+type cipherWriter struct {
+	c *rc4.Cipher
+	w io.Writer
+}
+
+// Write encrypts into a copy, as callers may reuse b.
+func (c cipherWriter) Write(b []byte) (int, error) {
+	encrypted := make([]byte, len(b))
+	c.c.XORKeyStream(encrypted, b)
+	return c.w.Write(encrypted)
+}
+
+func mseKeyPair() (private, public *big.Int) {
+	privateBytes := make([]byte, 20)
+	if _, err := rand.Read(privateBytes); err != nil {
+		panic(err)
+	}
+	private = new(big.Int).SetBytes(privateBytes)
+	return private, new(big.Int).Exp(mseG, private, mseP)
+}
+
+// msePad pads a number to the 96 bytes of a key.
+func msePad(n *big.Int) []byte {
+	padded := make([]byte, mseKeySize)
+	b := n.Bytes()
+	copy(padded[mseKeySize-len(b):], b)
+	return padded
+}
+
+func mseSharedSecret(private *big.Int, otherPublic []byte) []byte {
+	return msePad(new(big.Int).Exp(new(big.Int).SetBytes(otherPublic), private, mseP))
+}
+
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+func mseCipher(name string, secret, infoHash []byte) *rc4.Cipher {
+	c, err := rc4.NewCipher(mseHash([]byte(name), secret, infoHash))
+	if err != nil {
+		panic(err)
+	}
+	discard := make([]byte, mseRC4Discard)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func msePublicKeyAndPad(public *big.Int) []byte {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		panic(err)
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(mseMaxPadSize+1))
+	if _, err := rand.Read(pad); err != nil {
+		panic(err)
+	}
+	return append(msePad(public), pad...)
+}
+
+// mseSync skips the random padding the other side sent, by reading until
+// pattern, which must follow it within maxSkip bytes.
+func mseSync(br *bufio.Reader, pattern []byte, maxSkip int) error {
+	window := make([]byte, 0, maxSkip+len(pattern))
+	for len(window) < cap(window) {
+		c, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, c)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Synchronization pattern not found")
+}
+
+func readDecrypted(r io.Reader, c *rc4.Cipher, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	c.XORKeyStream(b, b)
+	return b, nil
+}
+
+// mseInitiate runs the outgoing side of the encryption handshake, offering
+// the methods in provide, and returns the connection to continue the
+// BitTorrent handshake on.
+func mseInitiate(conn net.Conn, infoHash []byte, provide uint32) (net.Conn, error) {
+	c, err := mseInitiateSteps(conn, infoHash, provide)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errEncryptionHandshake, err)
+	}
+	return c, nil
+}
+
+func mseInitiateSteps(conn net.Conn, infoHash []byte, provide uint32) (net.Conn, error) {
+	private, public := mseKeyPair()
+	if _, err := conn.Write(msePublicKeyAndPad(public)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	otherPublic := make([]byte, mseKeySize)
+	if _, err := io.ReadFull(br, otherPublic); err != nil {
+		return nil, err
+	}
+	secret := mseSharedSecret(private, otherPublic)
+	encrypt := mseCipher("keyA", secret, infoHash)
+	decrypt := mseCipher("keyB", secret, infoHash)
+
+	msg := mseHash([]byte("req1"), secret)
+	req2, req3 := mseHash([]byte("req2"), infoHash), mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		msg = append(msg, req2[i]^req3[i])
+	}
+	// VC, crypto_provide, no padding and no initial payload.
+	plain := make([]byte, 16)
+	binary.BigEndian.PutUint32(plain[8:12], provide)
+	encrypted := make([]byte, len(plain))
+	encrypt.XORKeyStream(encrypted, plain)
+	if _, err := conn.Write(append(msg, encrypted...)); err != nil {
+		return nil, err
+	}
+
+	encryptedVC := make([]byte, len(mseVC))
+	decrypt.XORKeyStream(encryptedVC, mseVC)
+	if err := mseSync(br, encryptedVC, mseMaxPadSize); err != nil {
+		return nil, err
+	}
+	resp, err := readDecrypted(br, decrypt, 6)
+	if err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(resp[:4])
+	padLen := int(binary.BigEndian.Uint16(resp[4:6]))
+	if padLen > mseMaxPadSize {
+		return nil, fmt.Errorf("Padding of %d bytes is too long", padLen)
+	}
+	if _, err := readDecrypted(br, decrypt, padLen); err != nil {
+		return nil, err
+	}
+	if selected&provide == 0 || selected&(selected-1) != 0 {
+		return nil, fmt.Errorf("Peer selected crypto method %#x, we provided %#x", selected, provide)
+	}
+
+	return newMseConn(conn, br, nil, selected, encrypt, decrypt), nil
+}
+
+// mseRespond runs the incoming side of the encryption handshake, for a
+// connection to one of infoHashes, selecting one of the methods in allowed.
+// It returns the info hash the peer asked for.
+func mseRespond(conn net.Conn, br *bufio.Reader, infoHashes [][]byte, allowed uint32) (net.Conn, []byte, error) {
+	c, infoHash, err := mseRespondSteps(conn, br, infoHashes, allowed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errEncryptionHandshake, err)
+	}
+	return c, infoHash, nil
+}
+
+func mseRespondSteps(conn net.Conn, br *bufio.Reader, infoHashes [][]byte, allowed uint32) (net.Conn, []byte, error) {
+	otherPublic := make([]byte, mseKeySize)
+	if _, err := io.ReadFull(br, otherPublic); err != nil {
+		return nil, nil, err
+	}
+	private, public := mseKeyPair()
+	if _, err := conn.Write(msePublicKeyAndPad(public)); err != nil {
+		return nil, nil, err
+	}
+	secret := mseSharedSecret(private, otherPublic)
+
+	if err := mseSync(br, mseHash([]byte("req1"), secret), mseMaxPadSize); err != nil {
+		return nil, nil, err
+	}
+	skeyHash := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(br, skeyHash); err != nil {
+		return nil, nil, err
+	}
+	req3 := mseHash([]byte("req3"), secret)
+	var infoHash []byte
+	for _, candidate := range infoHashes {
+		req2 := mseHash([]byte("req2"), candidate)
+		matches := true
+		for i := range req2 {
+			if skeyHash[i] != req2[i]^req3[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			infoHash = candidate
+			break
+		}
+	}
+	if infoHash == nil {
+		return nil, nil, fmt.Errorf("Peer wants a torrent other than %x", infoHashes[0])
+	}
+	decrypt := mseCipher("keyA", secret, infoHash)
+	encrypt := mseCipher("keyB", secret, infoHash)
+
+	req, err := readDecrypted(br, decrypt, 14)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(req[:8], mseVC) {
+		return nil, nil, fmt.Errorf("Invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(req[8:12])
+	padLen := int(binary.BigEndian.Uint16(req[12:14]))
+	if padLen > mseMaxPadSize {
+		return nil, nil, fmt.Errorf("Padding of %d bytes is too long", padLen)
+	}
+	if _, err := readDecrypted(br, decrypt, padLen); err != nil {
+		return nil, nil, err
+	}
+	payloadLenBytes, err := readDecrypted(br, decrypt, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Usually the initial payload is the peer's BitTorrent handshake.
+	initialPayload, err := readDecrypted(br, decrypt, int(binary.BigEndian.Uint16(payloadLenBytes)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var selected uint32
+	switch {
+	case provide&allowed&mseCryptoRC4 != 0:
+		selected = mseCryptoRC4
+	case provide&allowed&mseCryptoPlaintext != 0:
+		selected = mseCryptoPlaintext
+	default:
+		return nil, nil, fmt.Errorf("No common crypto method. Peer provided %#x, we allow %#x", provide, allowed)
+	}
+
+	// VC, crypto_select and no padding.
+	resp := make([]byte, 14)
+	binary.BigEndian.PutUint32(resp[8:12], selected)
+	encrypt.XORKeyStream(resp, resp)
+	if _, err := conn.Write(resp); err != nil {
+		return nil, nil, err
+	}
+
+	return newMseConn(conn, br, initialPayload, selected, encrypt, decrypt), infoHash, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+type mseResult struct {
+	conn     net.Conn
+	infoHash []byte
+	err      error
+}
+
+// mseLoopback runs the MSE handshake over a loopback TCP connection, with the
+// initiator offering provide and the responder accepting allowed.
+func mseLoopback(t *testing.T, infoHash []byte, provide uint32, responderInfoHashes [][]byte, allowed uint32) (net.Conn, error, mseResult) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	responded := make(chan mseResult, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			responded <- mseResult{err: err}
+			return
+		}
+		encrypted, got, err := mseRespond(conn, bufio.NewReader(conn), responderInfoHashes, allowed)
+		if err != nil {
+			conn.Close()
+		}
+		responded <- mseResult{encrypted, got, err}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiated, err := mseInitiate(conn, infoHash, provide)
+	if err != nil {
+		conn.Close()
+	}
+	return initiated, err, <-responded
+}
+
+func TestMSERoundTrip(t *testing.T) {
+	infoHash := []byte("0123456789abcdefghij")
+	other := []byte("jihgfedcba9876543210")
+	tests := []struct {
+		name             string
+		provide, allowed uint32
+	}{
+		{"rc4", mseCryptoRC4, mseCryptoRC4 | mseCryptoPlaintext},
+		{"plaintext", mseCryptoPlaintext, mseCryptoRC4 | mseCryptoPlaintext},
+		{"both offered", mseCryptoRC4 | mseCryptoPlaintext, mseCryptoRC4 | mseCryptoPlaintext},
+		{"rc4 required", mseCryptoRC4 | mseCryptoPlaintext, mseCryptoRC4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initiator, err, responder := mseLoopback(t, infoHash, tt.provide, [][]byte{other, infoHash}, tt.allowed)
+			if err != nil || responder.err != nil {
+				t.Fatalf("Handshake failed: %v, %v", err, responder.err)
+			}
+			defer initiator.Close()
+			defer responder.conn.Close()
+			if !bytes.Equal(responder.infoHash, infoHash) {
+				t.Fatalf("Responder got info hash %x, expected %x", responder.infoHash, infoHash)
+			}
+
+			request := bytes.Repeat([]byte("request "), 4096)
+			go initiator.Write(request)
+			got := make([]byte, len(request))
+			if _, err := io.ReadFull(responder.conn, got); err != nil || !bytes.Equal(got, request) {
+				t.Fatalf("Responder read %d bytes, err %v", len(got), err)
+			}
+
+			reply := []byte("reply")
+			go responder.conn.Write(reply)
+			got = make([]byte, len(reply))
+			if _, err := io.ReadFull(initiator, got); err != nil || !bytes.Equal(got, reply) {
+				t.Fatalf("Initiator read %q, err %v", got, err)
+			}
+		})
+	}
+}
+
+func TestMSEHandshakeFails(t *testing.T) {
+	infoHash := []byte("0123456789abcdefghij")
+	other := []byte("jihgfedcba9876543210")
+	tests := []struct {
+		name             string
+		infoHashes       [][]byte
+		provide, allowed uint32
+	}{
+		{"unknown info hash", [][]byte{other}, mseCryptoRC4, mseCryptoRC4},
+		{"no common method", [][]byte{infoHash}, mseCryptoPlaintext, mseCryptoRC4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initiator, err, responder := mseLoopback(t, infoHash, tt.provide, tt.infoHashes, tt.allowed)
+			if responder.err == nil {
+				responder.conn.Close()
+			}
+			if err == nil {
+				initiator.Close()
+			}
+			if responder.err == nil {
+				t.Fatalf("Handshake succeeded, expected it to fail")
+			}
+		})
+	}
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 func ParseTorrent(filename string) (*torrent, []byte, error) {
@@ -13,24 +18,280 @@ func ParseTorrent(filename string) (*torrent, []byte, error) {
 	torrContent := string(data)
 
 	torrDecoded, err := DecodeBencode(torrContent)
+	if err != nil {
+		return nil, nil, err
+	}
 	torrDict := torrDecoded.(map[string]interface{})
 	infoDict := torrDict["info"].(map[string]interface{})
-	infoHash := sha1.Sum([]byte(Bencode(infoDict)))
-	piecesString := infoDict["pieces"].(string)
-	pieces := make([]string, len(piecesString)/20)
-	for i := 0; i < len(piecesString); i += 20 {
-		pieces[i/20] = piecesString[i : i+20]
-	}
+	infoBencoded := []byte(Bencode(infoDict))
+	infoHash := sha1.Sum(infoBencoded)
 
 	t := torrent{
-		announce: torrDict["announce"].(string),
 		info: torrentInfo{
-			length:      infoDict["length"].(int),
 			name:        infoDict["name"].(string),
 			pieceLength: infoDict["piece length"].(int),
-			pieces:      pieces,
 		},
+		infoHash: infoHash[:],
+	}
+	if private, _ := infoDict["private"].(int); private == 1 {
+		t.info.private = true
+	}
+	// v2 torrents have no pieces, hybrid ones have both.
+	if piecesString, ok := infoDict["pieces"].(string); ok {
+		t.info.pieces = make([]string, len(piecesString)/20)
+		for i := 0; i < len(piecesString); i += 20 {
+			t.info.pieces[i/20] = piecesString[i : i+20]
+		}
+	}
+	// Trackerless torrents have no announce URL.
+	t.announce, _ = torrDict["announce"].(string)
+	if tiers, ok := torrDict["announce-list"].([]interface{}); ok {
+		for _, tier := range tiers {
+			tier, ok := tier.([]interface{})
+			if !ok {
+				continue
+			}
+			var urls []string
+			for _, url := range tier {
+				if url, ok := url.(string); ok && url != "" {
+					urls = append(urls, url)
+				}
+			}
+			if len(urls) > 0 {
+				t.announceList = append(t.announceList, urls)
+			}
+		}
+	}
+
+	if metaVersion, _ := infoDict["meta version"].(int); metaVersion == 2 {
+		if err := parseTorrentV2(&t, torrDict, infoDict); err != nil {
+			return nil, nil, err
+		}
+		infoHashV2 := sha256.Sum256(infoBencoded)
+		t.infoHashV2 = infoHashV2[:]
+		if t.info.pieces == nil {
+			// v2 info hashes are truncated to 20 bytes on the wire.
+			t.infoHash = t.infoHashV2[:20]
+		}
+	} else if files, ok := infoDict["files"].([]interface{}); ok {
+		t.info.multiFile = true
+		for _, file := range files {
+			fileDict, ok := file.(map[string]interface{})
+			if !ok {
+				return nil, nil, fmt.Errorf("Unexpected type in 'files'. Expected dict.")
+			}
+			tf, err := parseTorrentFile(fileDict)
+			if err != nil {
+				return nil, nil, err
+			}
+			t.info.files = append(t.info.files, tf)
+			t.info.length += tf.length
+		}
+	} else {
+		t.info.length = infoDict["length"].(int)
+		file := torrentFile{length: t.info.length, path: []string{t.info.name}}
+		if err := parseFileAttrs(infoDict, &file); err != nil {
+			return nil, nil, err
+		}
+		t.info.files = []torrentFile{file}
+	}
+
+	// url-list is either a single URL or a list of them.
+	switch urlList := torrDict["url-list"].(type) {
+	case string:
+		t.urlList = []string{urlList}
+	case []interface{}:
+		for _, url := range urlList {
+			if url, ok := url.(string); ok {
+				t.urlList = append(t.urlList, url)
+			}
+		}
+	}
+
+	return &t, t.infoHash, nil
+}
+
+func parseTorrentFile(fileDict map[string]interface{}) (torrentFile, error) {
+	length, ok := fileDict["length"].(int)
+	if !ok || length < 0 {
+		return torrentFile{}, fmt.Errorf("Expected a non-negative file length, got %v", fileDict["length"])
+	}
+	pathList, ok := fileDict["path"].([]interface{})
+	if !ok || len(pathList) == 0 {
+		return torrentFile{}, fmt.Errorf("Expected a non-empty file path, got %v", fileDict["path"])
+	}
+
+	path := make([]string, len(pathList))
+	for i, elem := range pathList {
+		path[i], ok = elem.(string)
+		if !ok || !validPathElement(path[i]) {
+			return torrentFile{}, fmt.Errorf("Invalid file path element %q", elem)
+		}
 	}
 
-	return &t, infoHash[:], nil
+	file := torrentFile{length: length, path: path}
+	if err := parseFileAttrs(fileDict, &file); err != nil {
+		return torrentFile{}, err
+	}
+	return file, nil
+}
+
+// parseFileAttrs reads the attributes of a file (BEP 47): whether it's
+// padding, executable, hidden or a symlink.
+func parseFileAttrs(fileDict map[string]interface{}, file *torrentFile) error {
+	attr, _ := fileDict["attr"].(string)
+	file.padding = strings.ContainsRune(attr, 'p')
+	file.executable = strings.ContainsRune(attr, 'x')
+	file.hidden = strings.ContainsRune(attr, 'h')
+	if !strings.ContainsRune(attr, 'l') {
+		return nil
+	}
+
+	if file.length != 0 {
+		return fmt.Errorf("Symlink %s has a length of %d, expected 0", strings.Join(file.path, "/"), file.length)
+	}
+	targetList, ok := fileDict["symlink path"].([]interface{})
+	if !ok || len(targetList) == 0 {
+		return fmt.Errorf("Expected a non-empty symlink path, got %v", fileDict["symlink path"])
+	}
+	file.symlink = make([]string, len(targetList))
+	for i, elem := range targetList {
+		file.symlink[i], ok = elem.(string)
+		if !ok || !validPathElement(file.symlink[i]) {
+			return fmt.Errorf("Invalid symlink path element %q", elem)
+		}
+	}
+	return nil
+}
+
+func validPathElement(elem string) bool {
+	return elem != "" && elem != "." && elem != ".." && !strings.ContainsAny(elem, "/\\")
+}
+
+// fileV2 is a file in the file tree of a v2 torrent.
+type fileV2 struct {
+	torrentFile
+	piecesRoot string
+}
+
+// parseTorrentV2 reads the file tree of a v2 torrent (BEP 52), and the
+// hashes its pieces are verified against. Files start at piece boundaries, so
+// padding files are inserted between them.
+func parseTorrentV2(t *torrent, torrDict map[string]interface{}, infoDict map[string]interface{}) error {
+	pieceLength := t.info.pieceLength
+	if pieceLength < merkleBlockSize || pieceLength&(pieceLength-1) != 0 {
+		return fmt.Errorf("Invalid piece length %d for a v2 torrent. Expected a power of two of at least 16 KiB.", pieceLength)
+	}
+	tree, ok := infoDict["file tree"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Expected a 'file tree' dict in a v2 torrent")
+	}
+	var files []fileV2
+	if err := walkFileTree(tree, nil, &files); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("Empty file tree")
+	}
+	layers, _ := torrDict["piece layers"].(map[string]interface{})
+
+	info := &t.info
+	info.files = nil
+	info.length = 0
+	info.multiFile = len(files) > 1 || len(files[0].path) > 1
+	leavesPerPiece := pieceLength / merkleBlockSize
+	padPieceHash := merkleRoot(nil, leavesPerPiece, merkleZeroLeaf)
+	for _, file := range files {
+		if file.length == 0 {
+			info.files = append(info.files, file.torrentFile)
+			continue
+		}
+		if rem := info.length % pieceLength; rem != 0 {
+			pad := pieceLength - rem
+			info.files = append(info.files, torrentFile{length: pad, path: []string{".pad", strconv.Itoa(pad)}, padding: true})
+			info.length += pad
+		}
+		info.files = append(info.files, file.torrentFile)
+		info.length += file.length
+
+		if len(file.piecesRoot) != sha256.Size {
+			return fmt.Errorf("Expected a 32 byte 'pieces root' for file %s", strings.Join(file.path, "/"))
+		}
+		numFilePieces := (file.length + pieceLength - 1) / pieceLength
+		if numFilePieces == 1 {
+			numBlocks := (file.length + merkleBlockSize - 1) / merkleBlockSize
+			info.piecesV2 = append(info.piecesV2, pieceHashV2{file.piecesRoot, file.length, nextPowerOfTwo(numBlocks)})
+			continue
+		}
+
+		layer, _ := layers[file.piecesRoot].(string)
+		if len(layer) != numFilePieces*sha256.Size {
+			return fmt.Errorf("Expected a piece layer of %d hashes for file %s", numFilePieces, strings.Join(file.path, "/"))
+		}
+		hashes := make([][]byte, numFilePieces)
+		for i := range hashes {
+			hashes[i] = []byte(layer[i*sha256.Size : (i+1)*sha256.Size])
+		}
+		if string(merkleRoot(hashes, nextPowerOfTwo(numFilePieces), padPieceHash)) != file.piecesRoot {
+			return fmt.Errorf("Piece layer of file %s doesn't match its pieces root", strings.Join(file.path, "/"))
+		}
+		for i, hash := range hashes {
+			length := file.length - i*pieceLength
+			if length > pieceLength {
+				length = pieceLength
+			}
+			info.piecesV2 = append(info.piecesV2, pieceHashV2{string(hash), length, leavesPerPiece})
+		}
+	}
+
+	if info.pieces != nil && len(info.pieces) != len(info.piecesV2) {
+		return fmt.Errorf("Hybrid torrent has %d v1 pieces but %d v2 pieces", len(info.pieces), len(info.piecesV2))
+	}
+	return nil
+}
+
+// walkFileTree lists the files in a file tree, in order. A file is a dict
+// with an empty key, holding its length and pieces root.
+func walkFileTree(tree map[string]interface{}, path []string, files *[]fileV2) error {
+	keys := make([]string, 0, len(tree))
+	for key := range tree {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		node, ok := tree[key].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Unexpected type in 'file tree'. Expected dict.")
+		}
+		if key == "" {
+			if len(path) == 0 {
+				return fmt.Errorf("File without a name in 'file tree'")
+			}
+			length, ok := node["length"].(int)
+			if attr, _ := node["attr"].(string); !ok && strings.ContainsRune(attr, 'l') {
+				// Symlinks may leave out their length.
+				length, ok = 0, true
+			}
+			if !ok || length < 0 {
+				return fmt.Errorf("Expected a non-negative file length, got %v", node["length"])
+			}
+			piecesRoot, _ := node["pieces root"].(string)
+			file := torrentFile{length: length, path: append([]string{}, path...)}
+			if err := parseFileAttrs(node, &file); err != nil {
+				return err
+			}
+			// v2 torrents have no padding files, it's implied.
+			file.padding = false
+			*files = append(*files, fileV2{file, piecesRoot})
+			continue
+		}
+		if !validPathElement(key) {
+			return fmt.Errorf("Invalid file path element %q", key)
+		}
+		if err := walkFileTree(node, append(path[:len(path):len(path)], key), files); err != nil {
+			return err
+		}
+	}
+	return nil
 }
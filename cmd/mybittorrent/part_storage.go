@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Files are downloaded to their path with this suffix, and renamed once done.
+const partSuffix = ".part"
+
+// PartStorage is a FileStorage which keeps each file at a ".part" path until
+// all of its pieces are complete, so a file at its final path is always whole.
+// A file that isn't wanted, but shares pieces with one that is, only gets
+// those pieces, and is renamed once they are complete.
+type PartStorage struct {
+	*FileStorage
+	outPath string
+
+	mu        sync.Mutex
+	completed []bool
+	remaining []int // pieces of each file that aren't complete yet
+}
+
+// NewPartStorage creates the files of torr at outPath, like NewFileStorage,
+// but with a ".part" suffix.
+func NewPartStorage(torr *torrent, outPath string, wanted []bool, prealloc Prealloc) (*PartStorage, error) {
+	return newPartStorage(torr, outPath, wanted, prealloc, false)
+}
+
+// ResumePartStorage is like NewPartStorage, but keeps the data of files that
+// exist, at either path. Files already renamed go back to their ".part" path
+// until the pieces they hold are marked complete again, e.g. once verified.
+func ResumePartStorage(torr *torrent, outPath string, wanted []bool, prealloc Prealloc) (*PartStorage, error) {
+	for _, file := range torr.info.files {
+		if file.padding || file.symlink != nil {
+			continue
+		}
+		path := filePath(&torr.info, outPath, file.path)
+		if _, err := os.Stat(path + partSuffix); !os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(path, path+partSuffix); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Failed to rename %s: %v", path, err)
+		}
+	}
+	return newPartStorage(torr, outPath, wanted, prealloc, true)
+}
+
+func newPartStorage(torr *torrent, outPath string, wanted []bool, prealloc Prealloc, keep bool) (*PartStorage, error) {
+	s := &PartStorage{
+		FileStorage: &FileStorage{info: &torr.info},
+		outPath:     outPath,
+		completed:   make([]bool, torr.info.numPieces()),
+		remaining:   make([]int, len(torr.info.files)),
+	}
+	if err := s.create(outPath, wanted, partSuffix, prealloc, keep); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	boundary := boundaryPieces(&torr.info, wanted)
+	for i, f := range s.files {
+		if f == nil {
+			continue
+		}
+		if len(boundary[i]) > 0 {
+			s.remaining[i] = len(boundary[i])
+			continue
+		}
+		first, last := torr.info.filePieces(i)
+		s.remaining[i] = last - first + 1
+		// Empty files are done already.
+		if s.remaining[i] == 0 {
+			if err := s.rename(i); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// MarkComplete renames the files which have all their pieces now.
+func (s *PartStorage) MarkComplete(pieceIndex int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.completed[pieceIndex] {
+		return nil
+	}
+	s.completed[pieceIndex] = true
+
+	offset := pieceIndex * s.info.pieceLength
+	for _, segment := range s.info.fileSegments(offset, s.info.pieceSize(pieceIndex)) {
+		if s.files[segment.file] == nil {
+			continue
+		}
+		s.remaining[segment.file]--
+		if s.remaining[segment.file] == 0 {
+			if err := s.rename(segment.file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rename moves a file to its final path. It stays open, so it can still be
+// read from.
+func (s *PartStorage) rename(fileIndex int) error {
+	path := filePath(s.info, s.outPath, s.info.files[fileIndex].path)
+	if err := os.Rename(path+partSuffix, path); err != nil {
+		return fmt.Errorf("Failed to rename %s%s: %v", path, partSuffix, err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestPieces writes pieces of data to storage, and marks them complete.
+func writeTestPieces(t *testing.T, torr *torrent, storage Storage, data []byte, pieces []int) {
+	t.Helper()
+	for _, pieceIndex := range pieces {
+		offset := pieceIndex * torr.info.pieceLength
+		if _, err := storage.WriteAt(data[offset:offset+torr.info.pieceSize(pieceIndex)], pieceIndex, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.MarkComplete(pieceIndex); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// partPaths returns which files of torr are at their final path, and which
+// at their ".part" path.
+func partPaths(torr *torrent, outPath string) (final []bool, part []bool) {
+	for _, file := range torr.info.files {
+		path := filePath(&torr.info, outPath, file.path)
+		_, err := os.Stat(path)
+		final = append(final, err == nil)
+		_, err = os.Stat(path + partSuffix)
+		part = append(part, err == nil)
+	}
+	return final, part
+}
+
+func TestPartStorageRenamesBoundaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	torr, data := newTestTorrent(t, dir, []int{40000, 100000, 50000})
+	outPath := filepath.Join(dir, "out")
+
+	// File 1 isn't wanted, but shares pieces 1 and 4 with the others.
+	storage, err := NewPartStorage(torr, outPath, []bool{true, false, true}, PreallocNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestPieces(t, torr, storage, data, []int{0, 1, 4, 5})
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	final, part := partPaths(torr, outPath)
+	if fmt.Sprint(final) != "[true true true]" || fmt.Sprint(part) != "[false false false]" {
+		t.Fatalf("Files at their final paths %v, at .part paths %v", final, part)
+	}
+}
+
+func TestResumePartStorage(t *testing.T) {
+	dir := t.TempDir()
+	torr, data := newTestTorrent(t, dir, []int{40000, 100000, 50000})
+	outPath := filepath.Join(dir, "out")
+
+	storage, err := NewPartStorage(torr, outPath, nil, PreallocNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestPieces(t, torr, storage, data, []int{0, 1, 2})
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	final, part := partPaths(torr, outPath)
+	if fmt.Sprint(final) != "[true false false]" || fmt.Sprint(part) != "[false true true]" {
+		t.Fatalf("Files at their final paths %v, at .part paths %v", final, part)
+	}
+
+	storage, err = ResumePartStorage(torr, outPath, nil, PreallocNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := Hashers.VerifyPieces(&torr.info, storage)
+	if fmt.Sprint(verified) != "[true true true false false false]" {
+		t.Fatalf("Verified pieces %v", verified)
+	}
+	var missing []int
+	for i, ok := range verified {
+		if ok {
+			if err := storage.MarkComplete(i); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	writeTestPieces(t, torr, storage, data, missing)
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	final, part = partPaths(torr, outPath)
+	if fmt.Sprint(final) != "[true true true]" || fmt.Sprint(part) != "[false false false]" {
+		t.Fatalf("Files at their final paths %v, at .part paths %v", final, part)
+	}
+	var got []byte
+	for _, file := range torr.info.files {
+		contents, err := os.ReadFile(filePath(&torr.info, outPath, file.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, contents...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Resumed files don't match")
+	}
+}
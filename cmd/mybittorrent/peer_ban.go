@@ -0,0 +1,73 @@
+package main
+
+import "fmt"
+
+// A peer is banned once it has this many strikes, when a piece that it sent
+// alone fails its hash check.
+const maxHashFailures = 3
+
+// blame works out who sent a piece that failed its hash check. A peer that
+// sent it on parole is banned. Otherwise each peer that sent part of it gets a
+// strike, and if there were several, the piece is downloaded again on parole
+// from one of them alone, to find out whether it's the bad one. Until then an
+// innocent peer may be a source of several bad pieces, so it's only banned for
+// its strikes if it was the only source.
+func (d *Downloader) blame(pieceIndex int, sources []*PeerConn, owner *PeerConn) {
+	if owner != nil {
+		d.ban(owner, fmt.Errorf("Sent piece %d on parole, which failed its hash check", pieceIndex))
+		return
+	}
+	if len(sources) == 1 {
+		host := peerHost(sources[0])
+		d.strikes[host]++
+		if d.strikes[host] >= maxHashFailures {
+			d.ban(sources[0], fmt.Errorf("Sent %d pieces which failed their hash check", d.strikes[host]))
+		}
+		return
+	}
+
+	var suspect *PeerConn
+	for _, peerConn := range sources {
+		host := peerHost(peerConn)
+		if d.banned[host] {
+			continue
+		}
+		d.strikes[host]++
+		if _, ok := d.peers[peerConn]; !ok {
+			continue
+		}
+		if suspect == nil || d.strikes[host] > d.strikes[peerHost(suspect)] {
+			suspect = peerConn
+		}
+	}
+	d.picker.SetParole(pieceIndex, suspect)
+}
+
+// acquit takes a strike off a peer that sent a whole piece on parole, which
+// was good.
+func (d *Downloader) acquit(peerConn *PeerConn) {
+	host := peerHost(peerConn)
+	if d.strikes[host] > 0 {
+		d.strikes[host]--
+	}
+}
+
+// ban drops all connections to the peer's IP address, and refuses new ones.
+func (d *Downloader) ban(peerConn *PeerConn, err error) {
+	host := peerHost(peerConn)
+	fmt.Printf("Banning peer %s: %v\n", host, err)
+	d.banned[host] = true
+	for other := range d.peers {
+		if peerHost(other) == host {
+			d.dropPeer(other, err)
+		}
+	}
+}
+
+// peerHost is the IP address of a peer, or the URL of a web seed.
+func peerHost(peerConn *PeerConn) string {
+	if peerConn.Peer.Ip == nil {
+		return peerConn.Conn.RemoteAddr().String()
+	}
+	return peerConn.Peer.Ip.String()
+}
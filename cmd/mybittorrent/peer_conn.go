@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errPeerConnClosed = errors.New("peer connection closed")
+
+const (
+	// A peer that sends nothing, not even a keep-alive, for this long is
+	// considered dead.
+	peerIdleTimeout   = 3 * time.Minute
+	keepAliveInterval = 90 * time.Second
+	peerWriteTimeout  = time.Minute
+)
+
+// PeerEvent is delivered by a PeerConn's reader goroutine for every message
+// read from the peer. The last event of a connection carries the error that
+// closed it.
+type PeerEvent struct {
+	Peer *PeerConn
+	Msg  PeerMessage
+	Err  error
+}
+
+// PeerConn is a full-duplex connection to a peer. Once started, a reader
+// goroutine dispatches incoming messages as PeerEvents and a writer goroutine
+// drains the outbound queue filled by Send.
+type PeerConn struct {
+	Conn        net.Conn
+	Peer        Peer
+	Handshake   *Handshake
+	ConnectedAt time.Time
+	Outgoing    bool // we dialed the peer, so Peer is its listen address
+
+	// mu guards the choke and interest state of both sides.
+	mu             sync.Mutex
+	interested     bool // we are interested in the peer
+	choked         bool // the peer is choking us
+	amChoking      bool // we are choking the peer
+	peerInterested bool // the peer is interested in us
+
+	outMu   sync.Mutex
+	outbox  []PeerMessage
+	outWake chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Limits on the traffic, set before Start.
+	downloadLimits rateLimiters
+	uploadLimits   rateLimiters
+
+	downloaded int64 // payload bytes received, accessed atomically
+	uploaded   int64 // payload bytes sent, accessed atomically
+}
+
+func NewPeerConn(conn net.Conn, peer Peer, peerHandshake *Handshake) *PeerConn {
+	return &PeerConn{
+		Conn:        conn,
+		Peer:        peer,
+		Handshake:   peerHandshake,
+		ConnectedAt: time.Now(),
+		choked:      true,
+		amChoking:   true,
+		outWake:     make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+}
+
+// SetRateLimits makes the connection's traffic wait for the download and
+// upload limiters. It must be called before Start.
+func (peerConn *PeerConn) SetRateLimits(download []*RateLimiter, upload []*RateLimiter) {
+	peerConn.downloadLimits = download
+	peerConn.uploadLimits = upload
+}
+
+// Start launches the reader and writer goroutines. Events are delivered on
+// events until the connection is closed, or until done is closed by the
+// consumer.
+func (peerConn *PeerConn) Start(events chan<- PeerEvent, done <-chan struct{}) {
+	go peerConn.readLoop(events, done)
+	go peerConn.writeLoop()
+}
+
+func (peerConn *PeerConn) Close() {
+	peerConn.closeOnce.Do(func() {
+		close(peerConn.closed)
+		peerConn.Conn.Close()
+	})
+}
+
+func (peerConn *PeerConn) Closed() <-chan struct{} {
+	return peerConn.closed
+}
+
+// Send queues msg for the writer goroutine.
+func (peerConn *PeerConn) Send(msg PeerMessage) error {
+	select {
+	case <-peerConn.closed:
+		return errPeerConnClosed
+	default:
+	}
+
+	peerConn.outMu.Lock()
+	peerConn.outbox = append(peerConn.outbox, msg)
+	peerConn.outMu.Unlock()
+
+	select {
+	case peerConn.outWake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// FastExtension reports whether the Fast Extension (BEP 6) is in use on this
+// connection.
+func (peerConn *PeerConn) FastExtension() bool {
+	return peerConn.Handshake != nil && peerConn.Handshake.SupportsFast()
+}
+
+func (peerConn *PeerConn) Interested() bool {
+	peerConn.mu.Lock()
+	defer peerConn.mu.Unlock()
+	return peerConn.interested
+}
+
+func (peerConn *PeerConn) Choked() bool {
+	peerConn.mu.Lock()
+	defer peerConn.mu.Unlock()
+	return peerConn.choked
+}
+
+func (peerConn *PeerConn) AmChoking() bool {
+	peerConn.mu.Lock()
+	defer peerConn.mu.Unlock()
+	return peerConn.amChoking
+}
+
+func (peerConn *PeerConn) PeerInterested() bool {
+	peerConn.mu.Lock()
+	defer peerConn.mu.Unlock()
+	return peerConn.peerInterested
+}
+
+// SetInterested sends an 'interested' or 'not interested' msg to the peer, if
+// that changes our interest in it.
+func (peerConn *PeerConn) SetInterested(interested bool) error {
+	peerConn.mu.Lock()
+	defer peerConn.mu.Unlock()
+	if peerConn.interested == interested {
+		return nil
+	}
+
+	msg := PeerMessage{pmidNotInterested, []byte{}}
+	if interested {
+		msg.id = pmidInterested
+	}
+	if err := peerConn.Send(msg); err != nil {
+		return err
+	}
+	peerConn.interested = interested
+
+	return nil
+}
+
+// SetChoking sends a 'choke' or 'unchoke' msg to the peer, if that changes
+// our choke state towards it. Choking also drops any blocks still queued for
+// the peer, which are explicitly rejected if the Fast Extension is in use.
+func (peerConn *PeerConn) SetChoking(choke bool) error {
+	peerConn.mu.Lock()
+	defer peerConn.mu.Unlock()
+	if peerConn.amChoking == choke {
+		return nil
+	}
+
+	msg := PeerMessage{pmidUnchoke, []byte{}}
+	if choke {
+		msg.id = pmidChoke
+	}
+	if err := peerConn.Send(msg); err != nil {
+		return err
+	}
+	if choke {
+		dropped := peerConn.dropQueued(func(queued PeerMessage) bool { return queued.id == pmidPiece })
+		peerConn.rejectDropped(dropped)
+	}
+	peerConn.amChoking = choke
+
+	return nil
+}
+
+// rejectDropped sends a 'reject request' for each dropped 'piece' msg, as the
+// Fast Extension requires every request to get an answer.
+func (peerConn *PeerConn) rejectDropped(dropped []PeerMessage) {
+	if !peerConn.FastExtension() {
+		return
+	}
+	for _, msg := range dropped {
+		req := blockRequest{
+			index:  int(binary.BigEndian.Uint32(msg.payload[0:4])),
+			begin:  int(binary.BigEndian.Uint32(msg.payload[4:8])),
+			length: len(msg.payload) - 8,
+		}
+		peerConn.Send(PeerMessage{pmidRejectRequest, req.payload()})
+	}
+}
+
+func (peerConn *PeerConn) Downloaded() int64 {
+	return atomic.LoadInt64(&peerConn.downloaded)
+}
+
+func (peerConn *PeerConn) Uploaded() int64 {
+	return atomic.LoadInt64(&peerConn.uploaded)
+}
+
+// idleTimeoutReader extends the read deadline of conn on every read, so any
+// traffic from the peer keeps the connection alive.
+type idleTimeoutReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r idleTimeoutReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(p)
+}
+
+func (peerConn *PeerConn) readLoop(events chan<- PeerEvent, done <-chan struct{}) {
+	defer peerConn.Close()
+
+	reader := rateLimitedReader{idleTimeoutReader{peerConn.Conn, peerIdleTimeout}, peerConn.downloadLimits, peerConn.closed}
+	for {
+		peerMsg, err := readPeerMessage(reader)
+		if err != nil {
+			select {
+			case <-peerConn.closed:
+				err = errPeerConnClosed
+			default:
+			}
+			select {
+			case events <- PeerEvent{Peer: peerConn, Err: err}:
+			case <-done:
+			}
+			return
+		}
+
+		peerConn.dispatch(peerMsg)
+		select {
+		case events <- PeerEvent{Peer: peerConn, Msg: peerMsg}:
+		case <-done:
+			return
+		}
+	}
+}
+
+// dispatch applies the connection-level effects of an incoming message before
+// it is handed to the download engine.
+func (peerConn *PeerConn) dispatch(msg PeerMessage) {
+	switch msg.id {
+	case pmidChoke, pmidUnchoke:
+		peerConn.mu.Lock()
+		peerConn.choked = msg.id == pmidChoke
+		peerConn.mu.Unlock()
+	case pmidInterested, pmidNotInterested:
+		peerConn.mu.Lock()
+		peerConn.peerInterested = msg.id == pmidInterested
+		peerConn.mu.Unlock()
+	case pmidPiece:
+		if len(msg.payload) > 8 {
+			atomic.AddInt64(&peerConn.downloaded, int64(len(msg.payload)-8))
+		}
+	case pmidCancel:
+		req, err := parseBlockRequest(msg.payload)
+		if err != nil {
+			return
+		}
+		dropped := peerConn.dropQueued(func(queued PeerMessage) bool {
+			return queued.id == pmidPiece && len(queued.payload) >= 8 &&
+				int(binary.BigEndian.Uint32(queued.payload[0:4])) == req.index &&
+				int(binary.BigEndian.Uint32(queued.payload[4:8])) == req.begin
+		})
+		peerConn.rejectDropped(dropped)
+	}
+}
+
+// dropQueued removes the queued messages matching drop that haven't been
+// written yet, and returns them.
+func (peerConn *PeerConn) dropQueued(drop func(PeerMessage) bool) []PeerMessage {
+	peerConn.outMu.Lock()
+	defer peerConn.outMu.Unlock()
+
+	var dropped []PeerMessage
+	kept := peerConn.outbox[:0]
+	for _, msg := range peerConn.outbox {
+		if drop(msg) {
+			dropped = append(dropped, msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	peerConn.outbox = kept
+	return dropped
+}
+
+func (peerConn *PeerConn) writeLoop() {
+	defer peerConn.Close()
+
+	keepAliveTicker := time.NewTicker(keepAliveInterval / 3)
+	defer keepAliveTicker.Stop()
+	lastWrite := time.Now()
+
+	for {
+		select {
+		case <-peerConn.closed:
+			return
+		case <-keepAliveTicker.C:
+			if time.Since(lastWrite) < keepAliveInterval {
+				continue
+			}
+			peerConn.Conn.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+			if err := sendKeepAlive(peerConn.Conn); err != nil {
+				return
+			}
+			lastWrite = time.Now()
+			continue
+		case <-peerConn.outWake:
+		}
+
+		for {
+			peerConn.outMu.Lock()
+			if len(peerConn.outbox) == 0 {
+				peerConn.outMu.Unlock()
+				break
+			}
+			msg := peerConn.outbox[0]
+			peerConn.outbox = peerConn.outbox[1:]
+			peerConn.outMu.Unlock()
+
+			if !peerConn.uploadLimits.wait(5+len(msg.payload), peerConn.closed) {
+				return
+			}
+			peerConn.Conn.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+			if err := sendPeerMessage(peerConn.Conn, msg); err != nil {
+				return
+			}
+			lastWrite = time.Now()
+			if msg.id == pmidPiece && len(msg.payload) > 8 {
+				atomic.AddInt64(&peerConn.uploaded, int64(len(msg.payload)-8))
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Azureus-style prefix identifying this client ("GB") and its version (0001).
+const peerIdPrefix = "-GB0001-"
+
+// identifyTimeout bounds connecting to a peer just to learn its peer ID.
+const identifyTimeout = 5 * time.Second
+
+// PeerIdFileEnv names an env var pointing to a file where the peer ID is kept,
+// so it stays the same across runs. By default every run gets a new one.
+const PeerIdFileEnv = "BITTORRENT_PEER_ID_FILE"
+
+// PeerId identifies this client session to trackers and peers.
+var PeerId = NewPeerId()
+
+func NewPeerId() string {
+	id := make([]byte, 20)
+	copy(id, peerIdPrefix)
+	if _, err := rand.Read(id[len(peerIdPrefix):]); err != nil {
+		panic(err)
+	}
+	return string(id)
+}
+
+// LoadOrCreatePeerId reads a hex-encoded peer ID from path, or generates one
+// and saves it there if the file doesn't exist yet.
+func LoadOrCreatePeerId(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		id, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(id) != 20 {
+			return "", fmt.Errorf("Expected 20 hex-encoded bytes in peer ID file %s", path)
+		}
+		return string(id), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id := NewPeerId()
+	err = os.WriteFile(path, []byte(hex.EncodeToString([]byte(id))+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Azureus-style client codes, as in "-TR2940-".
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"GB": "bittorrent-go",
+	"KT": "KTorrent",
+	"LT": "libtorrent (Rasterbar)",
+	"lt": "libTorrent (rakshasa)",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// Shadow-style client codes, as in "S58B-----".
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow's client",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// ClientName identifies the client software of a peer from its peer ID.
+func ClientName(peerId []byte) string {
+	if len(peerId) != 20 {
+		return "unknown"
+	}
+
+	if peerId[0] == '-' && peerId[7] == '-' {
+		name, ok := azureusClients[string(peerId[1:3])]
+		if !ok {
+			name = fmt.Sprintf("unknown (%s)", peerId[1:3])
+		}
+		return name + " " + peerIdVersion(peerId[3:7])
+	}
+
+	if peerId[0] == 'M' && strings.Contains(string(peerId[1:8]), "-") {
+		// Mainline, as in "M4-3-6--"
+		version := strings.Trim(string(peerId[1:8]), "-")
+		return "Mainline " + strings.ReplaceAll(version, "-", ".")
+	}
+
+	if name, ok := shadowClients[peerId[0]]; ok && strings.Contains(string(peerId[1:9]), "---") {
+		version := string(peerId[1:6])
+		version = version[:strings.Index(version+"-", "-")]
+		return name + " " + peerIdVersion([]byte(version))
+	}
+
+	return "unknown"
+}
+
+// IdentifyPeers fills in the IDs of the peers that came without one, as they
+// do in compact tracker responses, from their handshakes. Peers that can't be
+// reached are left without an ID.
+func IdentifyPeers(ctx context.Context, peers []Peer, infoHash []byte) {
+	var wg sync.WaitGroup
+	for i := range peers {
+		if peers[i].Id != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(peer *Peer) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, identifyTimeout)
+			defer cancel()
+			peerConn, err := ConnectToPeer(ctx, *peer, infoHash, false)
+			if err != nil {
+				return
+			}
+			peerConn.Close()
+			peer.Id = peerConn.Handshake.PeerId
+		}(&peers[i])
+	}
+	wg.Wait()
+}
+
+// peerIdVersion formats version digits, where letters stand for numbers
+// above 9, e.g. "2940" -> "2.9.4".
+func peerIdVersion(digits []byte) string {
+	parts := make([]string, 0, len(digits))
+	for _, c := range digits {
+		switch {
+		case c >= '0' && c <= '9':
+			parts = append(parts, string(c))
+		case c >= 'A' && c <= 'Z':
+			parts = append(parts, fmt.Sprint(int(c-'A')+10))
+		case c >= 'a' && c <= 'z':
+			parts = append(parts, fmt.Sprint(int(c-'a')+36))
+		default:
+			parts = append(parts, string(c))
+		}
+	}
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestIdentifyPeers(t *testing.T) {
+	torr, data := newTestTorrent(t, t.TempDir(), []int{1000})
+	seeder := startTestSeeder(t, &testSeeder{
+		torr:     torr,
+		infoHash: torr.infoHash,
+		data:     data,
+		has:      func(int) bool { return true },
+		peerId:   "-qB4250-abcdefghijkl",
+	})
+	// A peer that doesn't accept connections.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+	unreachable := Peer{Ip: addr.IP, Port: uint(addr.Port)}
+	known := Peer{Ip: net.IPv4(10, 0, 0, 1), Port: 1, Id: []byte("-TR3000-abcdefghijkl")}
+
+	peers := []Peer{seeder, unreachable, known}
+	IdentifyPeers(context.Background(), peers, torr.infoHash)
+	expected := []string{"qBittorrent 4.2.5", "unknown", "Transmission 3.0"}
+	for i, peer := range peers {
+		if got := ClientName(peer.Id); got != expected[i] {
+			t.Errorf("Peer %d is %q, expected %q", i, got, expected[i])
+		}
+	}
+	if peers[1].Id != nil {
+		t.Errorf("The unreachable peer got ID %q", peers[1].Id)
+	}
+}
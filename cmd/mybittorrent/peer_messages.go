@@ -23,8 +23,19 @@ const (
 	pmidRequest       pmid = 6
 	pmidPiece         pmid = 7
 	pmidCancel        pmid = 8
+
+	// Fast Extension (BEP 6)
+	pmidSuggestPiece  pmid = 13
+	pmidHaveAll       pmid = 14
+	pmidHaveNone      pmid = 15
+	pmidRejectRequest pmid = 16
+	pmidAllowedFast   pmid = 17
 )
 
+// Messages longer than this are treated as a protocol violation, so a peer
+// can't make us allocate arbitrary amounts of memory.
+const maxPeerMessageLength = 1 << 20
+
 func readPeerMessage(reader io.Reader) (PeerMessage, error) {
 	msgLen := uint32(0)
 
@@ -37,6 +48,9 @@ func readPeerMessage(reader io.Reader) (PeerMessage, error) {
 		msgLen = binary.BigEndian.Uint32(msgLenBytes)
 		// If msgLen is 0, it's a keepalive message, and we should ignore it.
 	}
+	if msgLen > maxPeerMessageLength {
+		return PeerMessage{}, fmt.Errorf("Peer message too long: %d bytes", msgLen)
+	}
 
 	msgPayloadBytes := make([]byte, msgLen)
 	_, err := io.ReadFull(reader, msgPayloadBytes)
@@ -51,23 +65,36 @@ func readPeerMessage(reader io.Reader) (PeerMessage, error) {
 }
 
 func sendPeerMessage(writer io.Writer, msg PeerMessage) error {
-	msgLenBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(msgLenBytes, uint32(1+len(msg.payload)))
+	msgBytes := make([]byte, 5, 5+len(msg.payload))
+	binary.BigEndian.PutUint32(msgBytes[0:4], uint32(1+len(msg.payload)))
+	msgBytes[4] = byte(msg.id)
+	msgBytes = append(msgBytes, msg.payload...)
 
-	bytesWritten, err := writer.Write(msgLenBytes)
-	if err == nil && bytesWritten < len(msgLenBytes) {
-		err = fmt.Errorf("sendPeerMessage: wrote %d bytes instead of %d", bytesWritten, len(msgLenBytes))
+	bytesWritten, err := writer.Write(msgBytes)
+	if err == nil && bytesWritten < len(msgBytes) {
+		err = fmt.Errorf("sendPeerMessage: wrote %d bytes instead of %d", bytesWritten, len(msgBytes))
 	}
 
-	bytesWritten, err = writer.Write([]byte{byte(msg.id)})
-	if err == nil && bytesWritten < 1 {
-		err = fmt.Errorf("sendPeerMessage: wrote %d bytes instead of %d", bytesWritten, 1)
-	}
-
-	bytesWritten, err = writer.Write(msg.payload)
-	if err == nil && bytesWritten < len(msg.payload) {
-		err = fmt.Errorf("sendPeerMessage: wrote %d bytes instead of %d", bytesWritten, len(msg.payload))
-	}
+	return err
+}
 
+func sendKeepAlive(writer io.Writer) error {
+	_, err := writer.Write([]byte{0, 0, 0, 0})
 	return err
 }
+
+// pieceIndexMessage builds the messages whose payload is a single piece
+// index: 'have', 'suggest piece' and 'allowed fast'.
+func pieceIndexMessage(id pmid, pieceIndex int) PeerMessage {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(pieceIndex))
+	return PeerMessage{id, payload}
+}
+
+func pieceMessage(pieceIndex int, blockBegin int, block []byte) PeerMessage {
+	payload := make([]byte, 8, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(pieceIndex))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(blockBegin))
+	payload = append(payload, block...)
+	return PeerMessage{pmidPiece, payload}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Peer Exchange (BEP 11) messages are sent about once a minute, and list the
+// peers we connected to or lost since the previous one.
+const (
+	pexInterval = time.Minute
+	maxPexPeers = 50
+)
+
+// Flags describing each added peer.
+const (
+	pexFlagEncryption = 0x01
+	pexFlagSeed       = 0x02
+	pexFlagUTP        = 0x04
+	pexFlagHolepunch  = 0x08
+	pexFlagReachable  = 0x10
+)
+
+type pexPeer struct {
+	peer  Peer
+	flags byte
+}
+
+func pexMessageDict(added []pexPeer, dropped []Peer) map[string]interface{} {
+	var added4, added6, addedFlags4, addedFlags6, dropped4, dropped6 []byte
+	for _, p := range added {
+		if p.peer.Ip.To4() != nil {
+			added4 = append(added4, compactPeer(p.peer)...)
+			addedFlags4 = append(addedFlags4, p.flags)
+		} else {
+			added6 = append(added6, compactPeer(p.peer)...)
+			addedFlags6 = append(addedFlags6, p.flags)
+		}
+	}
+	for _, peer := range dropped {
+		if peer.Ip.To4() != nil {
+			dropped4 = append(dropped4, compactPeer(peer)...)
+		} else {
+			dropped6 = append(dropped6, compactPeer(peer)...)
+		}
+	}
+
+	return map[string]interface{}{
+		"added":    string(added4),
+		"added.f":  string(addedFlags4),
+		"added6":   string(added6),
+		"added6.f": string(addedFlags6),
+		"dropped":  string(dropped4),
+		"dropped6": string(dropped6),
+	}
+}
+
+func parsePexMessage(payload []byte) ([]pexPeer, []Peer, error) {
+	decoded, err := DecodeBencode(string(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("Unexpected type in ut_pex msg. Expected dict.")
+	}
+	str := func(key string) []byte {
+		val, _ := dict[key].(string)
+		return []byte(val)
+	}
+
+	var added []pexPeer
+	for _, family := range []struct {
+		key   string
+		peers []Peer
+	}{
+		{"added", parseCompactPeers(str("added"))},
+		{"added6", parseCompactPeers6(str("added6"))},
+	} {
+		flags := str(family.key + ".f")
+		for i, peer := range family.peers {
+			p := pexPeer{peer: peer}
+			if i < len(flags) {
+				p.flags = flags[i]
+			}
+			added = append(added, p)
+		}
+	}
+	dropped := append(parseCompactPeers(str("dropped")), parseCompactPeers6(str("dropped6"))...)
+
+	return added, dropped, nil
+}
+
+func compactPeer(peer Peer) []byte {
+	ip := peer.Ip.To4()
+	if ip == nil {
+		ip = peer.Ip.To16()
+	}
+	compact := make([]byte, len(ip)+2)
+	copy(compact, ip)
+	binary.BigEndian.PutUint16(compact[len(ip):], uint16(peer.Port))
+	return compact
+}
+
+func parseCompactPeers6(peersBytes []byte) []Peer {
+	peers := make([]Peer, 0, len(peersBytes)/18)
+	for i := 0; i+18 <= len(peersBytes); i += 18 {
+		ip := net.IP(peersBytes[i : i+16])
+		port := uint(binary.BigEndian.Uint16(peersBytes[i+16 : i+18]))
+		peers = append(peers, Peer{Ip: ip, Port: port})
+	}
+	return peers
+}
+
+// pexAddr returns the address other peers can reach a connected peer on. For
+// incoming connections, it's only known if the peer told us its listen port.
+func (d *Downloader) pexAddr(peerConn *PeerConn, state *peerState) (Peer, bool) {
+	if peerConn.Outgoing {
+		return peerConn.Peer, true
+	}
+	if state.listenPort > 0 {
+		return Peer{Ip: peerConn.Peer.Ip, Port: uint(state.listenPort)}, true
+	}
+	return Peer{}, false
+}
+
+// sendPex tells every peer that supports ut_pex which peers we connected to
+// and lost since our last message to it.
+func (d *Downloader) sendPex() {
+	current := d.pexPeers()
+	for peerConn, state := range d.peers {
+		d.sendPexTo(peerConn, state, current)
+	}
+}
+
+// pexPeers lists the connected peers that others can connect to, by address.
+func (d *Downloader) pexPeers() map[string]pexPeer {
+	current := make(map[string]pexPeer, len(d.peers))
+	for peerConn, state := range d.peers {
+		peer, ok := d.pexAddr(peerConn, state)
+		if !ok {
+			continue
+		}
+		p := pexPeer{peer: peer}
+		if peerConn.Outgoing {
+			p.flags |= pexFlagReachable
+		}
+		if state.bitfield.Complete(d.numPieces) {
+			p.flags |= pexFlagSeed
+		}
+		current[peer.Addr()] = p
+	}
+	return current
+}
+
+func (d *Downloader) sendPexTo(peerConn *PeerConn, state *peerState, current map[string]pexPeer) {
+	extId, ok := state.extensions["ut_pex"]
+	if !ok || d.torr.info.private {
+		return
+	}
+	self, _ := d.pexAddr(peerConn, state)
+
+	var added []pexPeer
+	for addr, p := range current {
+		if _, sent := state.pexSent[addr]; !sent && addr != self.Addr() && len(added) < maxPexPeers {
+			added = append(added, p)
+			state.pexSent[addr] = p.peer
+		}
+	}
+	var dropped []Peer
+	for addr, peer := range state.pexSent {
+		if _, ok := current[addr]; !ok && len(dropped) < maxPexPeers {
+			dropped = append(dropped, peer)
+			delete(state.pexSent, addr)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return
+	}
+
+	peerConn.Send(extendedMessage(extId, Bencode(pexMessageDict(added, dropped))))
+}
+
+func (d *Downloader) handlePex(peerConn *PeerConn, payload []byte) {
+	// Peers of private torrents come only from the trackers.
+	if d.torr.info.private {
+		return
+	}
+	added, _, err := parsePexMessage(payload)
+	if err != nil {
+		fmt.Printf("Ignoring malformed ut_pex msg from %s: %v\n", peerConn.Conn.RemoteAddr(), err)
+		return
+	}
+
+	peers := make([]Peer, 0, len(added))
+	for _, p := range added {
+		peers = append(peers, p.peer)
+	}
+	d.AddPeers(peers)
+}
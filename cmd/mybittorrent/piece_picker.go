@@ -0,0 +1,535 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const BlockSize = 16 * 1024
+
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+func (req blockRequest) payload() []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(req.index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(req.begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(req.length))
+	return payload
+}
+
+func parseBlockRequest(payload []byte) (blockRequest, error) {
+	if len(payload) != 12 {
+		return blockRequest{}, fmt.Errorf("Expected 12 byte request payload, got %d bytes", len(payload))
+	}
+	return blockRequest{
+		index:  int(binary.BigEndian.Uint32(payload[0:4])),
+		begin:  int(binary.BigEndian.Uint32(payload[4:8])),
+		length: int(binary.BigEndian.Uint32(payload[8:12])),
+	}, nil
+}
+
+// pieceProgress holds the blocks of a piece that is being downloaded.
+type pieceProgress struct {
+	index       int
+	data        []byte
+	requestedBy [][]*PeerConn
+	received    []bool
+	from        []*PeerConn // the peer that sent each block
+	numReceived int
+	owner       *PeerConn // the only peer it's downloaded from, on parole
+}
+
+// sources returns the peers that sent blocks of the piece.
+func (pp *pieceProgress) sources() []*PeerConn {
+	var sources []*PeerConn
+	seen := make(map[*PeerConn]bool)
+	for _, peer := range pp.from {
+		if peer != nil && !seen[peer] {
+			seen[peer] = true
+			sources = append(sources, peer)
+		}
+	}
+	return sources
+}
+
+func (pp *pieceProgress) complete() bool {
+	return pp.numReceived == len(pp.received)
+}
+
+// Priority is how soon a piece, or file, should be downloaded. Pieces with
+// PrioritySkip aren't downloaded at all.
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func ParsePriority(priority string) (Priority, error) {
+	switch strings.ToLower(priority) {
+	case "skip":
+		return PrioritySkip, nil
+	case "low":
+		return PriorityLow, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return 0, fmt.Errorf("Unknown priority %q. Expected skip, low, normal or high.", priority)
+}
+
+// PiecePicker decides which blocks to request from which peer. It starts the
+// pieces with the highest priority first, and among those the rarest (or the
+// first ones, in sequential mode). It finishes pieces it has started before
+// starting new ones, and requests the last blocks from several peers at once
+// (endgame). Urgent pieces come before all others. Pieces on parole are only
+// downloaded from a single peer.
+type PiecePicker struct {
+	numPieces   int
+	pieceLength int
+	totalLength int
+	sequential  bool
+
+	priority     []Priority
+	urgent       map[int]bool
+	done         []bool
+	numRemaining int // wanted pieces that aren't done
+	availability []int
+	active       map[int]*pieceProgress
+	hashing      map[int]bool // pieces with all blocks, being verified
+	// Pieces on parole are downloaded from a single peer, the suspect if it's
+	// set, so a failure can be blamed on it.
+	parole   map[int]*PeerConn
+	requests map[*PeerConn]map[blockRequest]bool
+}
+
+func NewPiecePicker(numPieces int, pieceLength int, totalLength int) *PiecePicker {
+	priority := make([]Priority, numPieces)
+	for i := range priority {
+		priority[i] = PriorityNormal
+	}
+
+	return &PiecePicker{
+		numPieces:    numPieces,
+		pieceLength:  pieceLength,
+		totalLength:  totalLength,
+		priority:     priority,
+		urgent:       make(map[int]bool),
+		done:         make([]bool, numPieces),
+		numRemaining: numPieces,
+		availability: make([]int, numPieces),
+		active:       make(map[int]*pieceProgress),
+		hashing:      make(map[int]bool),
+		parole:       make(map[int]*PeerConn),
+		requests:     make(map[*PeerConn]map[blockRequest]bool),
+	}
+}
+
+func (picker *PiecePicker) PieceSize(pieceIndex int) int {
+	if pieceIndex == picker.numPieces-1 {
+		// last piece may be shorter than the others
+		return picker.totalLength - pieceIndex*picker.pieceLength
+	}
+	return picker.pieceLength
+}
+
+func (picker *PiecePicker) SetWanted(pieceIndex int, wanted bool) {
+	if wanted {
+		picker.SetPriority(pieceIndex, PriorityNormal)
+	} else {
+		picker.SetPriority(pieceIndex, PrioritySkip)
+	}
+}
+
+func (picker *PiecePicker) SetPriority(pieceIndex int, priority Priority) {
+	wasWanted := picker.wanted(pieceIndex)
+	picker.priority[pieceIndex] = priority
+	if picker.done[pieceIndex] || wasWanted == picker.wanted(pieceIndex) {
+		return
+	}
+	if wasWanted {
+		picker.numRemaining--
+	} else {
+		picker.numRemaining++
+	}
+}
+
+func (picker *PiecePicker) wanted(pieceIndex int) bool {
+	return picker.priority[pieceIndex] != PrioritySkip
+}
+
+// SetSequential makes the picker start pieces in order, instead of rarest
+// first.
+func (picker *PiecePicker) SetSequential(sequential bool) {
+	picker.sequential = sequential
+}
+
+// Prioritize wants a piece, and downloads it before any piece that isn't
+// urgent.
+func (picker *PiecePicker) Prioritize(pieceIndex int) {
+	if picker.done[pieceIndex] {
+		return
+	}
+	if !picker.wanted(pieceIndex) {
+		picker.SetPriority(pieceIndex, PriorityNormal)
+	}
+	picker.urgent[pieceIndex] = true
+}
+
+func (picker *PiecePicker) Done() bool {
+	return picker.numRemaining == 0
+}
+
+func (picker *PiecePicker) HasPiece(pieceIndex int) bool {
+	return picker.done[pieceIndex]
+}
+
+func (picker *PiecePicker) Bitfield() Bitfield {
+	bitfield := NewBitfield(picker.numPieces)
+	for i, done := range picker.done {
+		if done {
+			bitfield.SetPiece(i)
+		}
+	}
+	return bitfield
+}
+
+func (picker *PiecePicker) MarkDone(pieceIndex int) {
+	if picker.done[pieceIndex] {
+		return
+	}
+	picker.done[pieceIndex] = true
+	delete(picker.urgent, pieceIndex)
+	delete(picker.hashing, pieceIndex)
+	delete(picker.parole, pieceIndex)
+	if picker.wanted(pieceIndex) {
+		picker.numRemaining--
+	}
+	picker.removeActive(pieceIndex)
+}
+
+// PieceFailed discards the blocks of a piece that failed its hash check, so
+// it gets downloaded again.
+func (picker *PiecePicker) PieceFailed(pieceIndex int) {
+	delete(picker.hashing, pieceIndex)
+	picker.removeActive(pieceIndex)
+}
+
+// SetParole makes a piece be downloaded from one peer alone: suspect, or any
+// peer if it's nil or goes away.
+func (picker *PiecePicker) SetParole(pieceIndex int, suspect *PeerConn) {
+	picker.parole[pieceIndex] = suspect
+}
+
+func (picker *PiecePicker) removeActive(pieceIndex int) {
+	pp, ok := picker.active[pieceIndex]
+	if !ok {
+		return
+	}
+	for block, peers := range pp.requestedBy {
+		for _, peer := range peers {
+			delete(picker.requests[peer], picker.blockAt(pieceIndex, block))
+		}
+	}
+	delete(picker.active, pieceIndex)
+}
+
+// --- Availability ---
+
+func (picker *PiecePicker) PeerHave(pieceIndex int) {
+	if pieceIndex >= 0 && pieceIndex < picker.numPieces {
+		picker.availability[pieceIndex]++
+	}
+}
+
+func (picker *PiecePicker) PeerBitfield(bitfield Bitfield) {
+	for i := 0; i < picker.numPieces; i++ {
+		if bitfield.HasPiece(i) {
+			picker.availability[i]++
+		}
+	}
+}
+
+// PeerGone forgets the pieces a disconnected peer had, and frees the blocks
+// it was asked for.
+func (picker *PiecePicker) PeerGone(peer *PeerConn, bitfield Bitfield) {
+	for i := 0; i < picker.numPieces; i++ {
+		if bitfield.HasPiece(i) {
+			picker.availability[i]--
+		}
+	}
+	picker.UnrequestAll(peer)
+	delete(picker.requests, peer)
+
+	// Pieces on parole start over with another peer.
+	for pieceIndex, suspect := range picker.parole {
+		if suspect == peer {
+			picker.parole[pieceIndex] = nil
+		}
+	}
+	for pieceIndex, pp := range picker.active {
+		if pp.owner == peer {
+			picker.removeActive(pieceIndex)
+		}
+	}
+}
+
+// Interesting reports whether a peer with bitfield has any piece we still want.
+func (picker *PiecePicker) Interesting(bitfield Bitfield) bool {
+	for i := 0; i < picker.numPieces; i++ {
+		if picker.wanted(i) && !picker.done[i] && bitfield.HasPiece(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// --- Requests ---
+
+func (picker *PiecePicker) Outstanding(peer *PeerConn) int {
+	return len(picker.requests[peer])
+}
+
+// Pick returns up to n new blocks to request from peer, which has the pieces
+// in bitfield.
+func (picker *PiecePicker) Pick(peer *PeerConn, bitfield Bitfield, n int) []blockRequest {
+	picked := make([]blockRequest, 0, n)
+
+	// Urgent pieces go first, in order.
+	for _, pieceIndex := range sortedIndices(picker.urgent) {
+		if len(picked) >= n {
+			return picked
+		}
+		if !bitfield.HasPiece(pieceIndex) || picker.hashing[pieceIndex] {
+			continue
+		}
+		pp, ok := picker.active[pieceIndex]
+		if !ok {
+			if !picker.onParoleFor(pieceIndex, peer) {
+				continue
+			}
+			pp = picker.startPiece(pieceIndex, peer)
+		}
+		picked = picker.pickFromPiece(picked, n, peer, pp, false)
+	}
+
+	// Finish the pieces that are already in progress first.
+	for _, pieceIndex := range picker.activeIndices() {
+		if len(picked) >= n {
+			return picked
+		}
+		if bitfield.HasPiece(pieceIndex) {
+			picked = picker.pickFromPiece(picked, n, peer, picker.active[pieceIndex], false)
+		}
+	}
+
+	// Then start new pieces.
+	for len(picked) < n {
+		pieceIndex := picker.nextNewPiece(peer, bitfield)
+		if pieceIndex < 0 {
+			break
+		}
+		picked = picker.pickFromPiece(picked, n, peer, picker.startPiece(pieceIndex, peer), false)
+	}
+
+	// Endgame: once every remaining piece is in progress, ask for blocks that
+	// are already requested from other peers too.
+	if len(picked) == 0 && len(picker.active)+len(picker.hashing) == picker.numRemaining {
+		for _, pieceIndex := range picker.activeIndices() {
+			if len(picked) >= n {
+				break
+			}
+			if bitfield.HasPiece(pieceIndex) {
+				picked = picker.pickFromPiece(picked, n, peer, picker.active[pieceIndex], true)
+			}
+		}
+	}
+
+	return picked
+}
+
+func (picker *PiecePicker) activeIndices() []int {
+	indices := make([]int, 0, len(picker.active))
+	for pieceIndex := range picker.active {
+		indices = append(indices, pieceIndex)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+func sortedIndices(pieces map[int]bool) []int {
+	indices := make([]int, 0, len(pieces))
+	for pieceIndex := range pieces {
+		indices = append(indices, pieceIndex)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+func (picker *PiecePicker) isNewPiece(pieceIndex int, peer *PeerConn, bitfield Bitfield) bool {
+	if !picker.wanted(pieceIndex) || picker.done[pieceIndex] || picker.hashing[pieceIndex] || !bitfield.HasPiece(pieceIndex) {
+		return false
+	}
+	if !picker.onParoleFor(pieceIndex, peer) {
+		return false
+	}
+	_, ok := picker.active[pieceIndex]
+	return !ok
+}
+
+// nextNewPiece returns the piece to start next, out of the ones in bitfield,
+// or -1 if there is none.
+func (picker *PiecePicker) nextNewPiece(peer *PeerConn, bitfield Bitfield) int {
+	best := -1
+	for i := 0; i < picker.numPieces; i++ {
+		if !picker.isNewPiece(i, peer, bitfield) {
+			continue
+		}
+		if best < 0 || picker.priority[i] > picker.priority[best] {
+			best = i
+			continue
+		}
+		// Among pieces of the same priority, the first one wins in
+		// sequential mode, and the rarest one otherwise.
+		if picker.priority[i] == picker.priority[best] && !picker.sequential &&
+			picker.availability[i] < picker.availability[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// onParoleFor reports whether peer may start a piece: any peer may, unless
+// it's on parole with another suspect.
+func (picker *PiecePicker) onParoleFor(pieceIndex int, peer *PeerConn) bool {
+	suspect := picker.parole[pieceIndex]
+	return suspect == nil || suspect == peer
+}
+
+func (picker *PiecePicker) startPiece(pieceIndex int, peer *PeerConn) *pieceProgress {
+	pieceSize := picker.PieceSize(pieceIndex)
+	numBlocks := (pieceSize + BlockSize - 1) / BlockSize
+	pp := &pieceProgress{
+		index:       pieceIndex,
+		data:        make([]byte, pieceSize),
+		requestedBy: make([][]*PeerConn, numBlocks),
+		received:    make([]bool, numBlocks),
+		from:        make([]*PeerConn, numBlocks),
+	}
+	if _, ok := picker.parole[pieceIndex]; ok {
+		pp.owner = peer
+	}
+	picker.active[pieceIndex] = pp
+	return pp
+}
+
+func (picker *PiecePicker) pickFromPiece(picked []blockRequest, n int, peer *PeerConn, pp *pieceProgress, endgame bool) []blockRequest {
+	if pp.owner != nil && pp.owner != peer {
+		return picked
+	}
+	for block := range pp.received {
+		if len(picked) >= n {
+			break
+		}
+		if pp.received[block] || (len(pp.requestedBy[block]) > 0 && !endgame) {
+			continue
+		}
+		req := picker.blockAt(pp.index, block)
+		if picker.requests[peer][req] {
+			continue
+		}
+
+		pp.requestedBy[block] = append(pp.requestedBy[block], peer)
+		if picker.requests[peer] == nil {
+			picker.requests[peer] = make(map[blockRequest]bool)
+		}
+		picker.requests[peer][req] = true
+		picked = append(picked, req)
+	}
+	return picked
+}
+
+func (picker *PiecePicker) blockAt(pieceIndex int, block int) blockRequest {
+	begin := block * BlockSize
+	length := picker.PieceSize(pieceIndex) - begin
+	if length > BlockSize {
+		length = BlockSize
+	}
+	return blockRequest{pieceIndex, begin, length}
+}
+
+// Unrequest frees a block that peer won't send us, e.g. because it choked us.
+func (picker *PiecePicker) Unrequest(peer *PeerConn, req blockRequest) {
+	if !picker.requests[peer][req] {
+		return
+	}
+	delete(picker.requests[peer], req)
+
+	pp, ok := picker.active[req.index]
+	if !ok {
+		return
+	}
+	block := req.begin / BlockSize
+	peers := pp.requestedBy[block]
+	for i, p := range peers {
+		if p == peer {
+			pp.requestedBy[block] = append(peers[:i], peers[i+1:]...)
+			break
+		}
+	}
+}
+
+func (picker *PiecePicker) UnrequestAll(peer *PeerConn) {
+	for req := range picker.requests[peer] {
+		picker.Unrequest(peer, req)
+	}
+}
+
+// BlockReceived stores a block sent by peer. It returns the piece if this
+// block completed it, along with the other peers the block was requested from
+// and that should be sent a 'cancel'.
+func (picker *PiecePicker) BlockReceived(peer *PeerConn, pieceIndex int, begin int, data []byte) (*pieceProgress, []*PeerConn) {
+	pp, ok := picker.active[pieceIndex]
+	if !ok || begin%BlockSize != 0 || begin/BlockSize >= len(pp.received) {
+		return nil, nil
+	}
+	block := begin / BlockSize
+	req := picker.blockAt(pieceIndex, block)
+	// Blocks that weren't requested from the peer are dropped, so e.g. a piece
+	// on parole only has blocks from its owner.
+	if !picker.requests[peer][req] || pp.received[block] || len(data) != req.length {
+		picker.Unrequest(peer, req)
+		return nil, nil
+	}
+
+	copy(pp.data[begin:], data)
+	pp.received[block] = true
+	pp.from[block] = peer
+	pp.numReceived++
+
+	others := make([]*PeerConn, 0)
+	for _, p := range pp.requestedBy[block] {
+		delete(picker.requests[p], req)
+		if p != peer {
+			others = append(others, p)
+		}
+	}
+	pp.requestedBy[block] = nil
+
+	if !pp.complete() {
+		return nil, others
+	}
+	// It isn't picked again while it's verified, unless it fails.
+	delete(picker.active, pieceIndex)
+	picker.hashing[pieceIndex] = true
+	return pp, others
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prealloc is how the space of output files is set aside before downloading.
+type Prealloc int
+
+const (
+	// Files grow as pieces are written.
+	PreallocNone Prealloc = iota
+	// Files are truncated to their full length, without reserving disk space.
+	PreallocSparse
+	// Disk space is reserved for the files, so a full disk fails the download
+	// before it starts rather than near the end.
+	PreallocFull
+)
+
+func ParsePrealloc(prealloc string) (Prealloc, error) {
+	switch strings.ToLower(prealloc) {
+	case "none":
+		return PreallocNone, nil
+	case "sparse":
+		return PreallocSparse, nil
+	case "full":
+		return PreallocFull, nil
+	}
+	return 0, fmt.Errorf("Unknown preallocation %q. Expected none, sparse or full.", prealloc)
+}
+
+// preallocFile sets aside size bytes for a newly created file.
+func preallocFile(f *os.File, size int64, prealloc Prealloc) error {
+	var err error
+	switch prealloc {
+	case PreallocSparse:
+		err = f.Truncate(size)
+	case PreallocFull:
+		err = fallocate(f, size)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to preallocate %d bytes for %s: %v", size, f.Name(), err)
+	}
+	return nil
+}
+
+// checkDiskSpace fails if the file system at path has less than size bytes
+// free. Where free space can't be found out, it doesn't fail.
+func checkDiskSpace(path string, size int64) error {
+	free, ok := diskFree(path)
+	if ok && free < size {
+		return fmt.Errorf("Not enough disk space at %s: need %d bytes, %d are free", path, size, free)
+	}
+	return nil
+}
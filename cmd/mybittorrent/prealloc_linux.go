@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// fallocate reserves disk space for a file, or truncates it on file systems
+// that can't.
+func fallocate(f *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	for {
+		err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+		switch err {
+		case syscall.EINTR:
+			continue
+		case syscall.EOPNOTSUPP, syscall.ENOSYS:
+			return f.Truncate(size)
+		}
+		return err
+	}
+}
+
+// diskFree returns the space available to us on the file system at path, or
+// at its closest existing parent.
+func diskFree(path string) (int64, bool) {
+	for {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(path, &stat)
+		if err == nil {
+			return int64(stat.Bavail) * int64(stat.Bsize), true
+		}
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return 0, false
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// fallocate is only available on Linux. Elsewhere the file is truncated, which
+// may not reserve disk space.
+func fallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
+
+func diskFree(path string) (int64, bool) {
+	return 0, false
+}
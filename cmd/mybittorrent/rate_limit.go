@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Waits for a rate limiter are at most this long at a time, so a new rate
+// applies soon.
+const maxRateDelay = 100 * time.Millisecond
+
+// GlobalDownloadLimit and GlobalUploadLimit limit the traffic of all torrents
+// together. They are unlimited by default.
+var (
+	GlobalDownloadLimit = NewRateLimiter(0)
+	GlobalUploadLimit   = NewRateLimiter(0)
+)
+
+// RateLimiter is a token bucket which limits a rate in bytes per second.
+// Bytes are taken once they are known, which may leave the bucket in debt, and
+// the traffic then waits until it's paid back. The bucket holds at most a
+// second's worth of tokens.
+type RateLimiter struct {
+	// Bytes per second, 0 for no limit. Per-peer limiters share it with the
+	// limiter they were made from.
+	rate *int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate int) *RateLimiter {
+	r := int64(rate)
+	return &RateLimiter{rate: &r, last: time.Now()}
+}
+
+// SetRate changes the rate, in bytes per second, or removes the limit if it's
+// 0. It is safe to call from any goroutine.
+func (l *RateLimiter) SetRate(rate int) {
+	atomic.StoreInt64(l.rate, int64(rate))
+}
+
+func (l *RateLimiter) Rate() int {
+	return int(atomic.LoadInt64(l.rate))
+}
+
+// perPeer returns a limiter with a bucket of its own, whose rate is that of
+// l, and changes with it.
+func (l *RateLimiter) perPeer() *RateLimiter {
+	return &RateLimiter{rate: l.rate, last: time.Now()}
+}
+
+func (l *RateLimiter) refill(rate float64) {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	l.last = now
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+}
+
+func (l *RateLimiter) take(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate := float64(l.Rate())
+	if rate == 0 {
+		l.tokens = 0
+		l.last = time.Now()
+		return
+	}
+	l.refill(rate)
+	l.tokens -= float64(n)
+}
+
+// delay is how long until the bytes taken are paid back.
+func (l *RateLimiter) delay() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate := float64(l.Rate())
+	if rate == 0 {
+		return 0
+	}
+	l.refill(rate)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// rateLimiters apply together, e.g. the global, per-torrent and per-peer
+// limits of a connection.
+type rateLimiters []*RateLimiter
+
+// wait takes n bytes from each limiter, and blocks until all of them allow
+// it. It returns false if done is closed first.
+func (limiters rateLimiters) wait(n int, done <-chan struct{}) bool {
+	for _, l := range limiters {
+		l.take(n)
+	}
+	for {
+		var delay time.Duration
+		for _, l := range limiters {
+			if d := l.delay(); d > delay {
+				delay = d
+			}
+		}
+		if delay == 0 {
+			return true
+		}
+		if delay > maxRateDelay {
+			delay = maxRateDelay
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// rateLimitedReader waits for the limiters after each read.
+type rateLimitedReader struct {
+	r        io.Reader
+	limiters rateLimiters
+	done     <-chan struct{}
+}
+
+func (r rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 && !r.limiters.wait(n, r.done) && err == nil {
+		err = errPeerConnClosed
+	}
+	return n, err
+}
+
+// ParseRate parses a rate in bytes per second, like 500K or 2M, with binary
+// units. 0 means no limit.
+func ParseRate(rate string) (int, error) {
+	s := strings.ToUpper(strings.TrimSpace(rate))
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(value >= 0) || math.IsInf(value, 1) {
+		return 0, fmt.Errorf("Invalid rate %q. Expected bytes per second, like 500K or 2M.", rate)
+	}
+	return int(value * multiplier), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The schedule is checked this often, to apply its rates on time.
+const scheduleInterval = time.Minute
+
+// ScheduleRule sets the global rates during a time of day, in local time.
+type ScheduleRule struct {
+	// Since midnight. An end before the start wraps around midnight.
+	Start, End time.Duration
+	Download   int
+	Upload     int
+}
+
+// ParseScheduleRule parses a rule like 22:00-07:00=0/0 (unlimited at night)
+// or 09:00-18:00=1M/256K, giving the download and upload rates.
+func ParseScheduleRule(rule string) (ScheduleRule, error) {
+	invalid := fmt.Errorf("Invalid schedule rule %q. Expected <HH:MM>-<HH:MM>=<download>/<upload>, like 22:00-07:00=0/0.", rule)
+	eq := strings.Split(rule, "=")
+	if len(eq) != 2 {
+		return ScheduleRule{}, invalid
+	}
+	times := strings.Split(eq[0], "-")
+	rates := strings.Split(eq[1], "/")
+	if len(times) != 2 || len(rates) != 2 {
+		return ScheduleRule{}, invalid
+	}
+
+	var r ScheduleRule
+	var err error
+	if r.Start, err = parseTimeOfDay(times[0]); err != nil {
+		return ScheduleRule{}, invalid
+	}
+	if r.End, err = parseTimeOfDay(times[1]); err != nil {
+		return ScheduleRule{}, invalid
+	}
+	if r.Download, err = ParseRate(rates[0]); err != nil {
+		return ScheduleRule{}, err
+	}
+	if r.Upload, err = ParseRate(rates[1]); err != nil {
+		return ScheduleRule{}, err
+	}
+	return r, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (r ScheduleRule) contains(timeOfDay time.Duration) bool {
+	if r.Start <= r.End {
+		return timeOfDay >= r.Start && timeOfDay < r.End
+	}
+	return timeOfDay >= r.Start || timeOfDay < r.End
+}
+
+// RateSchedule sets the global rates by time of day. The first rule that
+// covers the time applies, and the default rates apply outside all rules.
+type RateSchedule struct {
+	Download int
+	Upload   int
+	Rules    []ScheduleRule
+}
+
+func (s *RateSchedule) ratesAt(t time.Time) (download int, upload int) {
+	timeOfDay := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	for _, rule := range s.Rules {
+		if rule.contains(timeOfDay) {
+			return rule.Download, rule.Upload
+		}
+	}
+	return s.Download, s.Upload
+}
+
+// Run sets the rates of download and upload as the schedule says, until ctx
+// is done.
+func (s *RateSchedule) Run(ctx context.Context, download *RateLimiter, upload *RateLimiter) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		downloadRate, uploadRate := s.ratesAt(time.Now())
+		download.SetRate(downloadRate)
+		upload.SetRate(uploadRate)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
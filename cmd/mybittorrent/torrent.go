@@ -1,13 +1,147 @@
 package main
 
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
 type torrent struct {
-	announce string
-	info     torrentInfo
+	announce     string
+	announceList [][]string // tiers of trackers (BEP 12)
+	urlList      []string   // web seeds (BEP 19)
+	info         torrentInfo
+	infoHash     []byte
+	// The full SHA-256 info hash of v2 and hybrid torrents (BEP 52).
+	infoHashV2 []byte
 }
 
 type torrentInfo struct {
-	length      int
+	length      int // of all files together
 	name        string
 	pieceLength int
-	pieces      []string
+	pieces      []string // SHA-1 hashes, nil in v2 torrents
+	// Merkle hashes of v2 and hybrid torrents, nil in v1 ones.
+	piecesV2 []pieceHashV2
+	// A single-file torrent has one file, whose path is the name.
+	files     []torrentFile
+	multiFile bool
+	// Private torrents (BEP 27) get peers only from their trackers.
+	private bool
+}
+
+type torrentFile struct {
+	length int
+	path   []string
+	// Attributes (BEP 47). Padding aligns the next file to a piece boundary,
+	// and is all zeros. It isn't written.
+	padding    bool
+	executable bool
+	hidden     bool
+	symlink    []string // the target's path in the torrent, for symlinks
+}
+
+func (info *torrentInfo) numPieces() int {
+	if info.pieces != nil {
+		return len(info.pieces)
+	}
+	return len(info.piecesV2)
+}
+
+// pieceSize is the length of a piece, as the last one may be shorter.
+func (info *torrentInfo) pieceSize(pieceIndex int) int {
+	if pieceIndex == info.numPieces()-1 {
+		return info.length - pieceIndex*info.pieceLength
+	}
+	return info.pieceLength
+}
+
+// fileSegment is the part of a file that a byte range of the torrent covers.
+type fileSegment struct {
+	file   int
+	offset int
+	length int
+}
+
+// fileSegments maps the byte range [offset, offset+length) of the torrent,
+// where the files are laid out one after the other, to the files.
+func (info *torrentInfo) fileSegments(offset int, length int) []fileSegment {
+	var segments []fileSegment
+	fileStart := 0
+	for i, file := range info.files {
+		fileEnd := fileStart + file.length
+		if length > 0 && offset < fileEnd && file.length > 0 {
+			n := fileEnd - offset
+			if n > length {
+				n = length
+			}
+			segments = append(segments, fileSegment{i, offset - fileStart, n})
+			offset += n
+			length -= n
+		}
+		fileStart = fileEnd
+	}
+	return segments
+}
+
+// contentLength is the size of the torrent's files, without padding.
+func (info *torrentInfo) contentLength() int {
+	length := 0
+	for _, file := range info.files {
+		if !file.padding {
+			length += file.length
+		}
+	}
+	return length
+}
+
+// fileOffset is where a file starts in the torrent.
+func (info *torrentInfo) fileOffset(file int) int {
+	offset := 0
+	for _, f := range info.files[:file] {
+		offset += f.length
+	}
+	return offset
+}
+
+// filePieces returns the first and last piece holding part of a file. An
+// empty file has no pieces, so last is less than first.
+func (info *torrentInfo) filePieces(file int) (first int, last int) {
+	if info.files[file].length == 0 {
+		return 0, -1
+	}
+	offset := info.fileOffset(file)
+	return offset / info.pieceLength, (offset + info.files[file].length - 1) / info.pieceLength
+}
+
+// matchFiles returns the files that selectors pick. A selector is the index
+// of a file, or a glob matched against its path in the torrent.
+func (info *torrentInfo) matchFiles(selectors []string) ([]int, error) {
+	var matched []int
+	for _, selector := range selectors {
+		if index, err := strconv.Atoi(selector); err == nil {
+			if index < 0 || index >= len(info.files) {
+				return nil, fmt.Errorf("Torrent has %d files, there is no file %d", len(info.files), index)
+			}
+			matched = append(matched, index)
+			continue
+		}
+
+		found := false
+		for i, file := range info.files {
+			ok, err := path.Match(selector, strings.Join(file.path, "/"))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid file pattern %q: %v", selector, err)
+			}
+			if ok {
+				matched = append(matched, i)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No file matches %q", selector)
+		}
+	}
+	return matched, nil
 }
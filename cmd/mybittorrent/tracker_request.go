@@ -1,12 +1,25 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
+)
+
+const trackerTimeout = 30 * time.Second
+
+// Values of the tracker request 'event' param. Regular re-announces send none.
+const (
+	TrackerEventNone      = ""
+	TrackerEventStarted   = "started"
+	TrackerEventCompleted = "completed"
+	TrackerEventStopped   = "stopped"
 )
 
 type TrackerResponse struct {
@@ -17,9 +30,14 @@ type TrackerResponse struct {
 type Peer struct {
 	Ip   net.IP
 	Port uint
+	Id   []byte // from non-compact tracker responses, or IdentifyPeers
 }
 
-func TrackerRequest(trackerURL string, infoHash []byte, peerId string) (*TrackerResponse, error) {
+func (peer Peer) Addr() string {
+	return net.JoinHostPort(peer.Ip.String(), strconv.Itoa(int(peer.Port)))
+}
+
+func TrackerRequest(ctx context.Context, trackerURL string, infoHash []byte, peerId string, event string) (*TrackerResponse, error) {
 	targetUrl, err := url.Parse(trackerURL)
 	if err != nil {
 		return nil, err
@@ -28,15 +46,24 @@ func TrackerRequest(trackerURL string, infoHash []byte, peerId string) (*Tracker
 	params := url.Values{}
 	params.Add("info_hash", string(infoHash))
 	params.Add("peer_id", peerId)
-	params.Add("port", "6881")
+	params.Add("port", fmt.Sprintf("%d", ListenPort))
 	params.Add("uploaded", "0")
 	params.Add("downloaded", "0")
 	params.Add("left", fmt.Sprintf("%d", 999))
 	params.Add("compact", "1")
+	if event != TrackerEventNone {
+		params.Add("event", event)
+	}
 
 	targetUrl.RawQuery = params.Encode()
 
-	resp, err := http.Get(targetUrl.String())
+	ctx, cancel := context.WithTimeout(ctx, trackerTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -72,18 +99,57 @@ func ParseTrackerResponse(resp *http.Response) (*TrackerResponse, error) {
 		}
 	}
 
-	peersStr, ok := respMap["peers"].(string)
-	if !ok {
-		return nil, fmt.Errorf("Unexpected type in key 'peers'. Expected string.")
+	var peers []Peer
+	switch peersVal := respMap["peers"].(type) {
+	case string:
+		peers = parseCompactPeers([]byte(peersVal))
+	case []interface{}:
+		peers, err = parsePeerDicts(peersVal)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unexpected type in key 'peers'. Expected string or list.")
 	}
 
-	peersBytes := []byte(peersStr)
+	return &TrackerResponse{interval, peers}, nil
+}
+
+func parseCompactPeers(peersBytes []byte) []Peer {
 	peers := make([]Peer, 0, len(peersBytes)/6)
-	for i := 0; i < len(peersBytes); i += 6 {
+	for i := 0; i+6 <= len(peersBytes); i += 6 {
 		ip := net.IP(peersBytes[i : i+4])
 		port := uint(binary.BigEndian.Uint16(peersBytes[i+4 : i+6]))
-		peers = append(peers, Peer{ip, port})
+		peers = append(peers, Peer{Ip: ip, Port: port})
 	}
+	return peers
+}
 
-	return &TrackerResponse{interval, peers}, nil
+// parsePeerDicts parses the original, non-compact peer list, where each peer
+// is a dict with its 'ip', 'port' and 'peer id'.
+func parsePeerDicts(peerDicts []interface{}) ([]Peer, error) {
+	peers := make([]Peer, 0, len(peerDicts))
+	for _, peerVal := range peerDicts {
+		peerDict, ok := peerVal.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Unexpected type in 'peers' list. Expected dict.")
+		}
+		ipStr, _ := peerDict["ip"].(string)
+		port, _ := peerDict["port"].(int)
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			ips, err := net.LookupIP(ipStr)
+			if err != nil || len(ips) == 0 {
+				continue
+			}
+			ip = ips[0]
+		}
+
+		peer := Peer{Ip: ip, Port: uint(port)}
+		if peerId, ok := peerDict["peer id"].(string); ok {
+			peer.Id = []byte(peerId)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// Trackers returns the tiers of trackers of the torrent, without duplicates.
+// As BEP 12 says, the announce URL is used only if there's no announce-list.
+func (torr *torrent) Trackers() [][]string {
+	if len(torr.announceList) == 0 {
+		if torr.announce == "" {
+			return nil
+		}
+		return [][]string{{torr.announce}}
+	}
+	var tiers [][]string
+	seen := make(map[string]bool)
+	for _, tier := range torr.announceList {
+		var urls []string
+		for _, url := range tier {
+			if url != "" && !seen[url] {
+				seen[url] = true
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			tiers = append(tiers, urls)
+		}
+	}
+	return tiers
+}
+
+// TrackerTiers announces to the trackers of a torrent as BEP 12 says. The
+// trackers of a tier are tried in a random order, and a tier only if all the
+// ones before it failed. A tracker that answers moves to the front of its
+// tier, so it's tried first from then on.
+type TrackerTiers struct {
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+func NewTrackerTiers(torr *torrent) *TrackerTiers {
+	tiers := torr.Trackers()
+	for _, tier := range tiers {
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+	}
+	return &TrackerTiers{tiers: tiers}
+}
+
+func (tt *TrackerTiers) Empty() bool {
+	return len(tt.tiers) == 0
+}
+
+// Announce sends the event to the first tracker that answers, and returns its
+// response.
+func (tt *TrackerTiers) Announce(ctx context.Context, infoHash []byte, event string) (*TrackerResponse, error) {
+	if tt.Empty() {
+		return nil, fmt.Errorf("The torrent has no trackers")
+	}
+	var lastErr error
+	for i := range tt.tiers {
+		tt.mu.Lock()
+		tier := append([]string(nil), tt.tiers[i]...)
+		tt.mu.Unlock()
+		for _, url := range tier {
+			trackerResp, err := TrackerRequest(ctx, url, infoHash, PeerId, event)
+			if err != nil {
+				fmt.Printf("Tracker %s failed: %v\n", url, err)
+				lastErr = err
+				if ctx.Err() != nil {
+					return nil, err
+				}
+				continue
+			}
+			tt.promote(i, url)
+			return trackerResp, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// promote moves a tracker to the front of its tier.
+func (tt *TrackerTiers) promote(tierIndex int, url string) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tier := tt.tiers[tierIndex]
+	for j, tracker := range tier {
+		if tracker == url {
+			copy(tier[1:j+1], tier[:j])
+			tier[0] = url
+			return
+		}
+	}
+}
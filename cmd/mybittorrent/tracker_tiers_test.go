@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// testTracker answers announces with a single peer on port, or fails if port
+// is 0. It counts the announces it gets.
+type testTracker struct {
+	*httptest.Server
+	announces int32
+}
+
+func startTestTracker(t *testing.T, port int) *testTracker {
+	t.Helper()
+	tracker := &testTracker{}
+	tracker.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tracker.announces, 1)
+		if port == 0 {
+			http.Error(w, "Tracker failure", http.StatusInternalServerError)
+			return
+		}
+		peers := []byte{127, 0, 0, 1, byte(port >> 8), byte(port)}
+		fmt.Fprintf(w, "d8:intervali60e5:peers%d:%se", len(peers), peers)
+	}))
+	t.Cleanup(tracker.Close)
+	return tracker
+}
+
+func TestTorrentTrackers(t *testing.T) {
+	tests := []struct {
+		announce     string
+		announceList [][]string
+		expected     [][]string
+	}{
+		{"", nil, nil},
+		{"http://a", nil, [][]string{{"http://a"}}},
+		// The announce URL is ignored when there's an announce-list.
+		{"http://a", [][]string{{"http://b", "http://c"}, {"http://d"}}, [][]string{{"http://b", "http://c"}, {"http://d"}}},
+		{"", [][]string{{"http://b", "http://b"}, {"http://b"}, {"http://c"}}, [][]string{{"http://b"}, {"http://c"}}},
+	}
+	for _, tt := range tests {
+		torr := &torrent{announce: tt.announce, announceList: tt.announceList}
+		if got := torr.Trackers(); fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+			t.Errorf("Trackers() of %q and %q = %q, expected %q", tt.announce, tt.announceList, got, tt.expected)
+		}
+	}
+}
+
+func TestTrackerTiersAnnounce(t *testing.T) {
+	failing := startTestTracker(t, 0)
+	working := startTestTracker(t, 1001)
+	backup := startTestTracker(t, 1002)
+	torr := &torrent{announceList: [][]string{{failing.URL, working.URL}, {backup.URL}}}
+	trackers := NewTrackerTiers(torr)
+	infoHash := make([]byte, 20)
+
+	for i := 0; i < 3; i++ {
+		trackerResp, err := trackers.Announce(context.Background(), infoHash, TrackerEventNone)
+		if err != nil {
+			t.Fatalf("Failed to announce: %v", err)
+		}
+		if len(trackerResp.Peers) != 1 || trackerResp.Peers[0].Port != 1001 {
+			t.Fatalf("Got peers %v, expected the one of the working tracker", trackerResp.Peers)
+		}
+	}
+	// The working tracker moved to the front of its tier after the first
+	// announce, so the failing one was tried at most once, and the next tier
+	// not at all.
+	if n := atomic.LoadInt32(&failing.announces); n > 1 {
+		t.Fatalf("The failing tracker got %d announces, expected at most 1", n)
+	}
+	if n := atomic.LoadInt32(&backup.announces); n != 0 {
+		t.Fatalf("The next tier got %d announces, expected none", n)
+	}
+
+	// Once the first tier fails, the next one is tried.
+	working.Close()
+	trackerResp, err := trackers.Announce(context.Background(), infoHash, TrackerEventNone)
+	if err != nil {
+		t.Fatalf("Failed to announce: %v", err)
+	}
+	if len(trackerResp.Peers) != 1 || trackerResp.Peers[0].Port != 1002 {
+		t.Fatalf("Got peers %v, expected the one of the next tier", trackerResp.Peers)
+	}
+}
+
+func TestTrackerTiersAllFail(t *testing.T) {
+	failing := startTestTracker(t, 0)
+	trackers := NewTrackerTiers(&torrent{announce: failing.URL})
+	if _, err := trackers.Announce(context.Background(), make([]byte, 20), TrackerEventStarted); err == nil {
+		t.Fatal("Announced to a failing tracker")
+	}
+	if _, err := NewTrackerTiers(&torrent{}).Announce(context.Background(), make([]byte, 20), TrackerEventStarted); err == nil {
+		t.Fatal("Announced without trackers")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const udpMuxBacklog = 256
+
+type muxPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// UDPMux shares one UDP socket between the DHT and uTP. KRPC messages are
+// bencoded dicts, so they start with 'd', which isn't a valid first byte of a
+// uTP packet.
+type UDPMux struct {
+	conn net.PacketConn
+	dht  *muxPacketConn
+	utp  *UTPSocket
+}
+
+// ListenUDP opens the UDP socket for the DHT and uTP on port, or on any free
+// port if it's taken.
+func ListenUDP(port int) (*UDPMux, error) {
+	conn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", port))
+	if err != nil {
+		conn, err = net.ListenPacket("udp4", ":0")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewUDPMux(conn), nil
+}
+
+func NewUDPMux(conn net.PacketConn) *UDPMux {
+	m := &UDPMux{
+		conn: conn,
+		dht: &muxPacketConn{
+			PacketConn: conn,
+			packets:    make(chan muxPacket, udpMuxBacklog),
+			closed:     make(chan struct{}),
+		},
+		utp: newUTPSocket(conn),
+	}
+	go m.readLoop()
+	return m
+}
+
+// DHTConn is the connection to run the DHT on.
+func (m *UDPMux) DHTConn() net.PacketConn {
+	return m.dht
+}
+
+func (m *UDPMux) UTP() *UTPSocket {
+	return m.utp
+}
+
+func (m *UDPMux) Close() error {
+	m.utp.Close()
+	m.dht.Close()
+	return m.conn.Close()
+}
+
+func (m *UDPMux) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			m.dht.Close()
+			m.utp.Close()
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n == 0 {
+			continue
+		}
+
+		if buf[0] == 'd' {
+			packet := muxPacket{append([]byte{}, buf[:n]...), addr}
+			select {
+			case m.dht.packets <- packet:
+			default:
+				// Drop it, as a full socket buffer would.
+			}
+		} else {
+			m.utp.handlePacket(buf[:n], udpAddr)
+		}
+	}
+}
+
+// muxPacketConn is the DHT's side of a UDPMux. Closing it doesn't close the
+// shared socket, and it doesn't support read deadlines.
+type muxPacketConn struct {
+	net.PacketConn
+	packets   chan muxPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *muxPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		return copy(b, packet.data), packet.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *muxPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *muxPacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *muxPacketConn) SetReadDeadline(t time.Time) error {
+	return errors.New("Read deadlines are not supported on a shared UDP socket")
+}
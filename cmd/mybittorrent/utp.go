@@ -0,0 +1,907 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	utpVersion    = 1
+	utpHeaderSize = 20
+
+	utpTypeData  = 0
+	utpTypeFin   = 1
+	utpTypeState = 2
+	utpTypeReset = 3
+	utpTypeSyn   = 4
+
+	utpExtSelectiveAck = 1
+
+	// Payload per packet, small enough to avoid IP fragmentation.
+	utpMaxPayload = 1200
+	// Bytes we buffer for the reader, advertised as our receive window.
+	utpRecvWindow = 1 << 20
+	// How far ahead of the next expected packet we buffer packets.
+	utpMaxOutOfOrder = 1024
+	utpMaxSackBytes  = 32
+
+	// LEDBAT: grow the congestion window while the queuing delay we add is
+	// below the target, and shrink it when it's above.
+	utpTargetDelay         = 100 * time.Millisecond
+	utpMaxCwndIncrease     = 3000 // bytes per RTT
+	utpMinCwnd             = 2 * utpMaxPayload
+	utpMaxCwnd             = 1 << 20
+	utpBaseDelayWindow     = time.Minute
+	utpMinRTO              = 500 * time.Millisecond
+	utpInitialRTO          = time.Second
+	utpMaxRTO              = 30 * time.Second
+	utpMaxTransmissions    = 6
+	utpDupAcksForFastRetry = 3
+
+	utpConnectTimeout = 3 * time.Second
+	utpTickInterval   = 50 * time.Millisecond
+	utpAcceptBacklog  = 32
+)
+
+var (
+	errUtpReset   = errors.New("uTP connection reset by peer")
+	errUtpTimeout = errors.New("uTP connection timed out")
+)
+
+// UTP is the uTP socket that outgoing peer connections try first, before
+// falling back to TCP. Nil to only use TCP.
+var UTP *UTPSocket
+
+type utpHeader struct {
+	typ           byte
+	connId        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+	// Selective ack: bit i is set if packet ackNr+2+i was received.
+	sack []byte
+}
+
+func (h *utpHeader) marshal(payload []byte) []byte {
+	size := utpHeaderSize + len(payload)
+	if len(h.sack) > 0 {
+		size += 2 + len(h.sack)
+	}
+	packet := make([]byte, utpHeaderSize, size)
+	packet[0] = h.typ<<4 | utpVersion
+	binary.BigEndian.PutUint16(packet[2:4], h.connId)
+	binary.BigEndian.PutUint32(packet[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(packet[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(packet[12:16], h.wndSize)
+	binary.BigEndian.PutUint16(packet[16:18], h.seqNr)
+	binary.BigEndian.PutUint16(packet[18:20], h.ackNr)
+	if len(h.sack) > 0 {
+		packet[1] = utpExtSelectiveAck
+		packet = append(packet, 0, byte(len(h.sack)))
+		packet = append(packet, h.sack...)
+	}
+	return append(packet, payload...)
+}
+
+// parseUtpPacket parses the header of a packet and its selective ack, skips
+// any other extensions, and returns the payload.
+func parseUtpPacket(packet []byte) (utpHeader, []byte, error) {
+	var h utpHeader
+	if len(packet) < utpHeaderSize {
+		return h, nil, fmt.Errorf("uTP packet too short: %d bytes", len(packet))
+	}
+	h.typ = packet[0] >> 4
+	if packet[0]&0x0f != utpVersion || h.typ > utpTypeSyn {
+		return h, nil, fmt.Errorf("Not a uTP packet")
+	}
+	h.connId = binary.BigEndian.Uint16(packet[2:4])
+	h.timestamp = binary.BigEndian.Uint32(packet[4:8])
+	h.timestampDiff = binary.BigEndian.Uint32(packet[8:12])
+	h.wndSize = binary.BigEndian.Uint32(packet[12:16])
+	h.seqNr = binary.BigEndian.Uint16(packet[16:18])
+	h.ackNr = binary.BigEndian.Uint16(packet[18:20])
+
+	extension, i := packet[1], utpHeaderSize
+	for extension != 0 {
+		if i+2 > len(packet) || i+2+int(packet[i+1]) > len(packet) {
+			return h, nil, fmt.Errorf("Truncated uTP extension")
+		}
+		next, length := packet[i], int(packet[i+1])
+		if extension == utpExtSelectiveAck {
+			h.sack = packet[i+2 : i+2+length]
+		}
+		extension = next
+		i += 2 + length
+	}
+
+	return h, packet[i:], nil
+}
+
+func utpTimestamp() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+func randomUint16() uint16 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// seqLess compares sequence numbers, which wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+type utpConnKey struct {
+	addr   string
+	recvId uint16
+}
+
+// UTPSocket runs uTP (BEP 29) connections over a UDP socket. It implements
+// net.Listener for incoming connections.
+type UTPSocket struct {
+	conn net.PacketConn
+
+	mu     sync.Mutex
+	conns  map[utpConnKey]*utpConn
+	accept chan *utpConn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newUTPSocket sends on conn. The packets it receives are passed to it with
+// handlePacket, as conn may be shared.
+func newUTPSocket(conn net.PacketConn) *UTPSocket {
+	s := &UTPSocket{
+		conn:   conn,
+		conns:  make(map[utpConnKey]*utpConn),
+		accept: make(chan *utpConn, utpAcceptBacklog),
+		closed: make(chan struct{}),
+	}
+	go s.tickLoop()
+	return s
+}
+
+func (s *UTPSocket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Accept waits for an incoming uTP connection.
+func (s *UTPSocket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections, and resets the open ones.
+func (s *UTPSocket) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.mu.Lock()
+		conns := make([]*utpConn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.reset()
+		}
+	})
+	return nil
+}
+
+// DialContext opens a uTP connection to addr.
+func (s *UTPSocket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var recvId uint16
+	for {
+		recvId = randomUint16()
+		_, taken := s.conns[utpConnKey{raddr.String(), recvId}]
+		if !taken {
+			break
+		}
+	}
+	c := newUtpConn(s, raddr, recvId, recvId+1)
+	c.seqNr = 1
+	s.conns[utpConnKey{raddr.String(), recvId}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.queue(utpTypeSyn, nil)
+	c.mu.Unlock()
+
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.dead:
+		err = c.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.closed:
+		err = net.ErrClosed
+	}
+	s.remove(c)
+	return nil, err
+}
+
+func (s *UTPSocket) remove(c *utpConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := utpConnKey{c.addr.String(), c.recvId}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *UTPSocket) send(packet []byte, addr *net.UDPAddr) {
+	s.conn.WriteTo(packet, addr)
+}
+
+func (s *UTPSocket) handlePacket(packet []byte, addr *net.UDPAddr) {
+	h, payload, err := parseUtpPacket(packet)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	c, ok := s.conns[utpConnKey{addr.String(), h.connId}]
+	if !ok && h.typ == utpTypeSyn {
+		// A new connection, unless the ack of its SYN got lost.
+		key := utpConnKey{addr.String(), h.connId + 1}
+		if c, ok = s.conns[key]; !ok {
+			c = s.newIncoming(key, addr, h)
+		}
+	}
+	s.mu.Unlock()
+
+	if c == nil {
+		if !ok && h.typ != utpTypeReset {
+			reset := utpHeader{typ: utpTypeReset, connId: h.connId, timestamp: utpTimestamp(), ackNr: h.seqNr}
+			s.send(reset.marshal(nil), addr)
+		}
+		return
+	}
+	c.receive(h, payload)
+}
+
+// newIncoming sets up a connection for a SYN, and returns nil if there's no
+// room for it in the accept backlog.
+func (s *UTPSocket) newIncoming(key utpConnKey, addr *net.UDPAddr, syn utpHeader) *utpConn {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+
+	c := newUtpConn(s, addr, key.recvId, syn.connId)
+	c.seqNr = randomUint16()
+	c.ackNr = syn.seqNr
+	c.setConnected()
+	select {
+	case s.accept <- c:
+	default:
+		return nil
+	}
+	s.conns[key] = c
+	return c
+}
+
+func (s *UTPSocket) tickLoop() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		conns := make([]*utpConn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			if c.tick(time.Now()) {
+				s.remove(c)
+			}
+		}
+	}
+}
+
+type utpPacket struct {
+	typ           byte
+	seqNr         uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	sacked        bool
+}
+
+// utpConn is a uTP connection. It implements net.Conn.
+type utpConn struct {
+	sock           *UTPSocket
+	addr           *net.UDPAddr
+	recvId, sendId uint16
+
+	mu    sync.Mutex
+	seqNr uint16 // of the next packet we send
+	ackNr uint16 // of the last packet we received in order
+
+	// Sending
+	unacked    []*utpPacket
+	inFlight   int
+	cwnd       float64
+	peerWnd    uint32
+	srtt       time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	dupAcks    int
+	recovering bool
+	recoverSeq uint16
+	// Lowest one-way delays our packets took in this and the previous
+	// minute, as measured by the peer.
+	baseDelays   [2]uint32
+	baseDelayAge time.Time
+	// One-way delay of the last packet we received, as we measured it.
+	replyMicros uint32
+
+	// Receiving
+	recvBuf    bytes.Buffer
+	outOfOrder map[uint16][]byte
+	gotFin     bool
+	finSeq     uint16
+	eof        bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+
+	connected   chan struct{}
+	isConnected bool
+	err         error
+	dead        chan struct{} // closed on err
+	closed      chan struct{} // closed by Close
+	closeOnce   sync.Once
+	localClosed bool
+}
+
+func newUtpConn(sock *UTPSocket, addr *net.UDPAddr, recvId, sendId uint16) *utpConn {
+	return &utpConn{
+		sock:         sock,
+		addr:         addr,
+		recvId:       recvId,
+		sendId:       sendId,
+		cwnd:         utpMinCwnd,
+		peerWnd:      utpMaxCwnd,
+		rto:          utpInitialRTO,
+		baseDelays:   [2]uint32{^uint32(0), ^uint32(0)},
+		baseDelayAge: time.Now(),
+		outOfOrder:   make(map[uint16][]byte),
+		readable:     make(chan struct{}, 1),
+		writable:     make(chan struct{}, 1),
+		connected:    make(chan struct{}),
+		dead:         make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is notified, the deadline passes, or the connection
+// dies or is closed.
+func (c *utpConn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+	case <-c.dead:
+	case <-c.closed:
+		return net.ErrClosed
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (c *utpConn) setConnected() {
+	if !c.isConnected {
+		c.isConnected = true
+		close(c.connected)
+	}
+}
+
+// fail kills the connection. c.mu must be held.
+func (c *utpConn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+		close(c.dead)
+	}
+}
+
+// sendPacket (re)transmits p. c.mu must be held.
+func (c *utpConn) sendPacket(p *utpPacket) {
+	h := c.header(p.typ)
+	h.seqNr = p.seqNr
+	if p.typ == utpTypeSyn {
+		h.connId = c.recvId
+	}
+	p.sentAt = time.Now()
+	p.transmissions++
+	c.sock.send(h.marshal(p.payload), c.addr)
+}
+
+func (c *utpConn) header(typ byte) utpHeader {
+	wnd := utpRecvWindow - c.recvBuf.Len()
+	if wnd < 0 {
+		wnd = 0
+	}
+	return utpHeader{
+		typ:           typ,
+		connId:        c.sendId,
+		timestamp:     utpTimestamp(),
+		timestampDiff: c.replyMicros,
+		wndSize:       uint32(wnd),
+		seqNr:         c.seqNr,
+		ackNr:         c.ackNr,
+		sack:          c.selectiveAck(),
+	}
+}
+
+// selectiveAck reports the packets we received after a missing one.
+// c.mu must be held.
+func (c *utpConn) selectiveAck() []byte {
+	if len(c.outOfOrder) == 0 {
+		return nil
+	}
+	var mask [utpMaxSackBytes]byte
+	size := 0
+	for seqNr := range c.outOfOrder {
+		i := int(uint16(seqNr - c.ackNr - 2))
+		if i >= len(mask)*8 {
+			continue
+		}
+		mask[i/8] |= 1 << (i % 8)
+		if i/8 >= size {
+			size = i/8 + 1
+		}
+	}
+	if size == 0 {
+		return nil
+	}
+	// The mask is a multiple of 4 bytes long.
+	size = (size + 3) / 4 * 4
+	return mask[:size]
+}
+
+// queue sends a packet that takes a sequence number, and keeps it until it's
+// acked. c.mu must be held.
+func (c *utpConn) queue(typ byte, payload []byte) {
+	p := &utpPacket{typ: typ, seqNr: c.seqNr, payload: payload}
+	c.seqNr++
+	c.unacked = append(c.unacked, p)
+	c.inFlight += len(payload)
+	c.sendPacket(p)
+}
+
+// sendAck sends a state packet. c.mu must be held.
+func (c *utpConn) sendAck() {
+	h := c.header(utpTypeState)
+	c.sock.send(h.marshal(nil), c.addr)
+}
+
+func (c *utpConn) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		h := c.header(utpTypeReset)
+		c.sock.send(h.marshal(nil), c.addr)
+	}
+	c.fail(net.ErrClosed)
+}
+
+func (c *utpConn) receive(h utpHeader, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	if h.typ == utpTypeReset {
+		c.fail(errUtpReset)
+		notify(c.readable)
+		notify(c.writable)
+		return
+	}
+	c.replyMicros = utpTimestamp() - h.timestamp
+	c.peerWnd = h.wndSize
+
+	if !c.isConnected {
+		if h.typ != utpTypeState {
+			return
+		}
+		// The peer's first data packet will have the seq_nr of its ack.
+		c.ackNr = h.seqNr - 1
+		c.setConnected()
+	}
+
+	c.handleAck(h)
+
+	switch h.typ {
+	case utpTypeData:
+		c.receiveData(h.seqNr, payload)
+	case utpTypeFin:
+		if !c.gotFin {
+			c.gotFin = true
+			c.finSeq = h.seqNr
+		}
+		c.receiveData(h.seqNr, nil)
+	case utpTypeSyn:
+		// Our ack of the SYN got lost.
+		c.sendAck()
+	}
+}
+
+// receiveData buffers a data (or FIN) packet, and passes what's now in order
+// to the reader. c.mu must be held.
+func (c *utpConn) receiveData(seqNr uint16, payload []byte) {
+	if seqLess(c.ackNr, seqNr) && uint16(seqNr-c.ackNr) <= utpMaxOutOfOrder {
+		if _, ok := c.outOfOrder[seqNr]; !ok {
+			// The payload is in the read buffer of the socket.
+			c.outOfOrder[seqNr] = append([]byte{}, payload...)
+		}
+		for {
+			next, ok := c.outOfOrder[c.ackNr+1]
+			if !ok {
+				break
+			}
+			delete(c.outOfOrder, c.ackNr+1)
+			c.ackNr++
+			c.recvBuf.Write(next)
+			if c.gotFin && c.ackNr == c.finSeq {
+				c.eof = true
+				break
+			}
+		}
+		notify(c.readable)
+	}
+	c.sendAck()
+}
+
+// handleAck drops the packets the peer acked, retransmits the ones it
+// reports missing, and adjusts the congestion window. c.mu must be held.
+func (c *utpConn) handleAck(h utpHeader) {
+	now := time.Now()
+	acked := 0
+	ackedPackets := 0
+	for len(c.unacked) > 0 && !seqLess(h.ackNr, c.unacked[0].seqNr) {
+		p := c.unacked[0]
+		if p.transmissions == 1 {
+			c.updateRTT(now.Sub(p.sentAt))
+		}
+		if !p.sacked {
+			acked += len(p.payload)
+		}
+		ackedPackets++
+		c.unacked = c.unacked[1:]
+	}
+	if len(h.sack) > 0 {
+		acked += c.handleSack(h.ackNr, h.sack)
+	}
+	c.inFlight -= acked
+
+	if ackedPackets == 0 {
+		if h.typ == utpTypeState && len(c.unacked) > 0 && h.ackNr == c.unacked[0].seqNr-1 {
+			c.dupAcks++
+			if c.dupAcks == utpDupAcksForFastRetry && c.unacked[0].transmissions == 1 {
+				c.lossDetected()
+				c.sendPacket(c.unacked[0])
+			}
+		}
+	} else {
+		c.dupAcks = 0
+		if c.recovering {
+			if !seqLess(h.ackNr, c.recoverSeq) {
+				c.recovering = false
+			} else if len(c.unacked) > 0 && c.unacked[0].transmissions == 1 {
+				// Partial ack: the next packet was lost too.
+				c.sendPacket(c.unacked[0])
+			}
+		}
+	}
+
+	if acked > 0 {
+		c.ledbat(acked, h.timestampDiff, now)
+		notify(c.writable)
+	}
+}
+
+// handleSack marks the packets in a selective ack as received, and
+// retransmits the ones that packets sent after them overtook. It returns the
+// newly acked bytes. c.mu must be held.
+func (c *utpConn) handleSack(ackNr uint16, sack []byte) int {
+	if len(c.unacked) == 0 {
+		return 0
+	}
+	acked := 0
+	first := c.unacked[0].seqNr
+	// The mask starts at ackNr+2, as ackNr+1 is missing by definition.
+	for i := 0; i < len(sack)*8; i++ {
+		if sack[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		k := int(int16(ackNr + 2 + uint16(i) - first))
+		if k < 0 || k >= len(c.unacked) {
+			continue
+		}
+		if p := c.unacked[k]; !p.sacked {
+			p.sacked = true
+			acked += len(p.payload)
+		}
+	}
+
+	overtaken := 0
+	for k := len(c.unacked) - 1; k >= 0; k-- {
+		p := c.unacked[k]
+		if p.sacked {
+			overtaken++
+			continue
+		}
+		if overtaken >= utpDupAcksForFastRetry && p.transmissions == 1 {
+			c.lossDetected()
+			c.sendPacket(p)
+		}
+	}
+	return acked
+}
+
+func (c *utpConn) updateRTT(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttVar = rtt / 2
+	} else {
+		delta := c.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.srtt += (rtt - c.srtt) / 8
+	}
+	c.rto = c.srtt + 4*c.rttVar
+	if c.rto < utpMinRTO {
+		c.rto = utpMinRTO
+	}
+}
+
+// ledbat grows or shrinks the congestion window in proportion to how far
+// the queuing delay is from the target.
+func (c *utpConn) ledbat(acked int, delay uint32, now time.Time) {
+	if delay == 0 {
+		return
+	}
+	if now.Sub(c.baseDelayAge) > utpBaseDelayWindow {
+		c.baseDelays[1], c.baseDelays[0] = c.baseDelays[0], ^uint32(0)
+		c.baseDelayAge = now
+	}
+	if delay < c.baseDelays[0] {
+		c.baseDelays[0] = delay
+	}
+	baseDelay := c.baseDelays[0]
+	if c.baseDelays[1] < baseDelay {
+		baseDelay = c.baseDelays[1]
+	}
+
+	queuingDelay := float64(delay - baseDelay)
+	target := float64(utpTargetDelay / time.Microsecond)
+	offTarget := (target - queuingDelay) / target
+	c.cwnd += utpMaxCwndIncrease * offTarget * float64(acked) / c.cwnd
+	if c.cwnd < utpMinCwnd {
+		c.cwnd = utpMinCwnd
+	}
+	if c.cwnd > utpMaxCwnd {
+		c.cwnd = utpMaxCwnd
+	}
+}
+
+// lossDetected halves the window, at most once per window of packets.
+// c.mu must be held.
+func (c *utpConn) lossDetected() {
+	if c.recovering {
+		return
+	}
+	c.recovering = true
+	c.recoverSeq = c.seqNr - 1
+	c.cwnd /= 2
+	if c.cwnd < utpMinCwnd {
+		c.cwnd = utpMinCwnd
+	}
+}
+
+// tick retransmits on timeout, and reports whether the connection is over
+// and can be forgotten.
+func (c *utpConn) tick(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return true
+	}
+	if len(c.unacked) == 0 {
+		return c.localClosed
+	}
+
+	p := c.unacked[0]
+	if now.Sub(p.sentAt) < c.rto {
+		return false
+	}
+	if p.transmissions >= utpMaxTransmissions {
+		c.fail(errUtpTimeout)
+		notify(c.readable)
+		notify(c.writable)
+		return true
+	}
+	c.rto *= 2
+	if c.rto > utpMaxRTO {
+		c.rto = utpMaxRTO
+	}
+	c.lossDetected()
+	c.cwnd = utpMinCwnd
+	c.sendPacket(p)
+	return false
+}
+
+func (c *utpConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.recvBuf.Len() > 0 {
+			wasFull := c.recvBuf.Len() > utpRecvWindow/2
+			n, _ := c.recvBuf.Read(b)
+			if wasFull && c.recvBuf.Len() <= utpRecvWindow/2 {
+				// Let the peer know there's room again.
+				c.sendAck()
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.eof {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if err := c.wait(c.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *utpConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		c.mu.Lock()
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+		if c.localClosed {
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		}
+
+		window := int(c.cwnd)
+		if int(c.peerWnd) < window {
+			window = int(c.peerWnd)
+		}
+		// With nothing in flight a packet is always allowed, to probe a
+		// closed window.
+		if c.inFlight < window || c.inFlight == 0 {
+			n := len(b) - written
+			if n > utpMaxPayload {
+				n = utpMaxPayload
+			}
+			payload := append([]byte{}, b[written:written+n]...)
+			c.queue(utpTypeData, payload)
+			written += n
+			c.mu.Unlock()
+			continue
+		}
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+
+		if err := c.wait(c.writable, deadline); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close sends a FIN. The data still in flight keeps being retransmitted
+// until the peer acks it.
+func (c *utpConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		if c.err == nil && c.isConnected {
+			c.queue(utpTypeFin, nil)
+		}
+		c.localClosed = true
+		c.mu.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.sock.Addr()
+}
+
+func (c *utpConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writable)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestUDPMux opens a UDPMux on a loopback port.
+func newTestUDPMux(t *testing.T) *UDPMux {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := NewUDPMux(conn)
+	t.Cleanup(func() { mux.Close() })
+	return mux
+}
+
+func TestUTPRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dialer := newTestUDPMux(t).UTP()
+	listener := newTestUDPMux(t).UTP()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	conn, err := dialer.DialContext(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	peer := <-accepted
+	if peer == nil {
+		t.Fatal("Failed to accept")
+	}
+	defer peer.Close()
+
+	// Much more than a window, so the stream is split into many packets.
+	sent := make([]byte, 1024*1024)
+	for i := range sent {
+		sent[i] = byte(i * 7)
+	}
+	go func() {
+		conn.Write(sent)
+		conn.Close()
+	}()
+	got, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if !bytes.Equal(got, sent) {
+		t.Fatalf("Read %d bytes which don't match the %d sent", len(got), len(sent))
+	}
+}
+
+func TestUTPEcho(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialer := newTestUDPMux(t).UTP()
+	listener := newTestUDPMux(t).UTP()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	conn, err := dialer.DialContext(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	for _, message := range []string{"ping", "a somewhat longer message", "pong"} {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		got := make([]byte, len(message))
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != message {
+			t.Fatalf("Read back %q, err %v, expected %q", got, err, message)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webSeedRequestTimeout = time.Minute
+	webSeedRetryInterval  = time.Minute
+	// Contiguous block requests are merged into HTTP requests of up to this
+	// many bytes.
+	webSeedMaxRange = 4 << 20
+)
+
+// webSeedAddr is the remote address of a web seed connection, for logging.
+type webSeedAddr string
+
+func (addr webSeedAddr) Network() string { return "http" }
+func (addr webSeedAddr) String() string  { return string(addr) }
+
+type webSeedConn struct {
+	net.Conn
+	addr webSeedAddr
+}
+
+func (c *webSeedConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// webSeed serves the blocks of a torrent from an HTTP(S) or FTP server that
+// hosts its files (BEP 19). It speaks the peer wire protocol on the other end
+// of an in-memory connection, so the downloader treats it as a peer that has
+// every piece and never chokes.
+type webSeed struct {
+	url    string
+	torr   *torrent
+	conn   net.Conn
+	limits rateLimiters // on the traffic with the server
+
+	mu       sync.Mutex
+	requests []blockRequest
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+// connectWebSeed starts a web seed, and returns the connection to it. The
+// web seed stops when the connection is closed.
+func (d *Downloader) connectWebSeed(seedURL string) *PeerConn {
+	ours, theirs := net.Pipe()
+	ws := &webSeed{
+		url:    seedURL,
+		torr:   d.torr,
+		conn:   theirs,
+		limits: rateLimiters{GlobalDownloadLimit, d.downloadLimit, d.peerDownloadLimit.perPeer()},
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go ws.serve()
+
+	hs := &Handshake{InfoHash: d.infoHash, PeerId: make([]byte, 20)}
+	return NewPeerConn(&webSeedConn{ours, webSeedAddr(seedURL)}, Peer{}, hs)
+}
+
+// AddWebSeed adds a web seed to download from. It must be called before Run.
+func (d *Downloader) AddWebSeed(seedURL string) {
+	d.webSeeds = append(d.webSeeds, seedURL)
+}
+
+// retryWebSeed reconnects to a web seed that failed, after a while.
+func (d *Downloader) retryWebSeed(seedURL string) {
+	d.dialing++
+	go func() {
+		select {
+		case <-time.After(webSeedRetryInterval):
+		case <-d.done:
+			return
+		}
+		peerConn := d.connectWebSeed(seedURL)
+		select {
+		case d.dialResults <- dialResult{Peer{}, peerConn, nil}:
+		case <-d.done:
+			peerConn.Close()
+		}
+	}()
+}
+
+func (ws *webSeed) serve() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer close(ws.done)
+	defer ws.conn.Close()
+	go ws.fetchLoop(ctx)
+
+	// Unlike a peer, a web seed has everything from the start.
+	numPieces := ws.torr.info.numPieces()
+	bitfield := NewBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bitfield.SetPiece(i)
+	}
+	if err := sendPeerMessage(ws.conn, PeerMessage{pmidBitfield, bitfield}); err != nil {
+		return
+	}
+
+	for {
+		msg, err := readPeerMessage(ws.conn)
+		if err != nil {
+			return
+		}
+
+		switch msg.id {
+		case pmidInterested:
+			if err := sendPeerMessage(ws.conn, PeerMessage{pmidUnchoke, []byte{}}); err != nil {
+				return
+			}
+		case pmidRequest:
+			req, err := parseBlockRequest(msg.payload)
+			if err != nil {
+				return
+			}
+			ws.mu.Lock()
+			ws.requests = append(ws.requests, req)
+			ws.mu.Unlock()
+			select {
+			case ws.wake <- struct{}{}:
+			default:
+			}
+		case pmidCancel:
+			req, err := parseBlockRequest(msg.payload)
+			if err != nil {
+				return
+			}
+			ws.mu.Lock()
+			for i, queued := range ws.requests {
+				if queued == req {
+					ws.requests = append(ws.requests[:i], ws.requests[i+1:]...)
+					break
+				}
+			}
+			ws.mu.Unlock()
+		}
+	}
+}
+
+// nextRun takes the queued requests that are contiguous in the torrent, so
+// they can be fetched with one HTTP request.
+func (ws *webSeed) nextRun() []blockRequest {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if len(ws.requests) == 0 {
+		return nil
+	}
+	pieceLength := ws.torr.info.pieceLength
+	run := ws.requests[:1]
+	size := run[0].length
+	for _, req := range ws.requests[1:] {
+		last := run[len(run)-1]
+		contiguous := req.index*pieceLength+req.begin == last.index*pieceLength+last.begin+last.length
+		if !contiguous || size+req.length > webSeedMaxRange {
+			break
+		}
+		run = ws.requests[:len(run)+1]
+		size += req.length
+	}
+	ws.requests = append([]blockRequest{}, ws.requests[len(run):]...)
+	return run
+}
+
+func (ws *webSeed) fetchLoop(ctx context.Context) {
+	defer ws.conn.Close()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		run := ws.nextRun()
+		if run == nil {
+			select {
+			case <-ws.done:
+				return
+			case <-ws.wake:
+			case <-keepAlive.C:
+				if err := sendKeepAlive(ws.conn); err != nil {
+					return
+				}
+			}
+			continue
+		}
+
+		pieceLength := ws.torr.info.pieceLength
+		offset := run[0].index*pieceLength + run[0].begin
+		length := 0
+		for _, req := range run {
+			length += req.length
+		}
+		data, err := ws.fetch(ctx, offset, length)
+		if err != nil {
+			fmt.Printf("Web seed %s failed: %v\n", ws.url, err)
+			return
+		}
+
+		for _, req := range run {
+			block := data[:req.length]
+			data = data[req.length:]
+			if err := sendPeerMessage(ws.conn, pieceMessage(req.index, req.begin, block)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// fetch downloads a byte range of the torrent, from the files it spans.
+func (ws *webSeed) fetch(ctx context.Context, offset int, length int) ([]byte, error) {
+	if offset < 0 || length <= 0 || offset+length > ws.torr.info.length {
+		return nil, fmt.Errorf("Range %d+%d is outside the torrent", offset, length)
+	}
+
+	data := make([]byte, 0, length)
+	for _, segment := range ws.torr.info.fileSegments(offset, length) {
+		if ws.torr.info.files[segment.file].padding {
+			data = append(data, make([]byte, segment.length)...)
+			continue
+		}
+		fileURL := ws.fileURL(segment.file)
+		var chunk []byte
+		var err error
+		if strings.HasPrefix(fileURL, "ftp://") {
+			chunk, err = ftpFetchRange(ctx, fileURL, segment.offset, segment.length, ws.limits)
+		} else {
+			chunk, err = httpFetchRange(ctx, fileURL, segment.offset, segment.length, ws.limits)
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// fileURL is where the web seed has a file. A URL ending in '/' is the
+// directory of the torrent; otherwise it's the file of a single-file torrent.
+func (ws *webSeed) fileURL(file int) string {
+	info := ws.torr.info
+	if !info.multiFile && !strings.HasSuffix(ws.url, "/") {
+		return ws.url
+	}
+
+	base := ws.url
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	parts := []string{url.PathEscape(info.name)}
+	if info.multiFile {
+		for _, elem := range info.files[file].path {
+			parts = append(parts, url.PathEscape(elem))
+		}
+	}
+	return base + strings.Join(parts, "/")
+}
+
+// httpFetchRange downloads length bytes at offset of the file at an http://
+// or https:// URL, waiting for limits as they arrive.
+func httpFetchRange(ctx context.Context, fileURL string, offset int, length int, limits rateLimiters) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, webSeedRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body := rateLimitedReader{resp.Body, limits, ctx.Done()}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range, so skip to it.
+		if _, err := io.CopyN(io.Discard, body, int64(offset)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("GET %s: %s", fileURL, resp.Status)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, fmt.Errorf("GET %s: %v", fileURL, err)
+	}
+	return data, nil
+}
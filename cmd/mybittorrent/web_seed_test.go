@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeRecorder serves dir over HTTP, and records the Range header of each
+// request.
+type rangeRecorder struct {
+	dir string
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (rr *rangeRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rr.mu.Lock()
+	rr.ranges = append(rr.ranges, r.Header.Get("Range"))
+	rr.mu.Unlock()
+	http.FileServer(http.Dir(rr.dir)).ServeHTTP(w, r)
+}
+
+func TestWebSeedFetchAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	torr, data := newTestTorrent(t, dir, []int{40000, 100, 70000})
+	recorder := &rangeRecorder{dir: dir}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	ws := &webSeed{url: server.URL + "/", torr: torr}
+	got, err := ws.fetch(context.Background(), 39000, 2000)
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	if !bytes.Equal(got, data[39000:41000]) {
+		t.Fatalf("Fetched data doesn't match")
+	}
+
+	expected := []string{"bytes=39000-39999", "bytes=0-99", "bytes=0-899"}
+	if fmt.Sprint(recorder.ranges) != fmt.Sprint(expected) {
+		t.Fatalf("Got ranges %q, expected %q", recorder.ranges, expected)
+	}
+}
+
+func TestWebSeedFetchIgnoredRange(t *testing.T) {
+	dir := t.TempDir()
+	torr, data := newTestTorrent(t, dir, []int{50000})
+	// The server sends the whole file, whatever the range.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	ws := &webSeed{url: server.URL + "/", torr: torr}
+	got, err := ws.fetch(context.Background(), 12345, 20000)
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	if !bytes.Equal(got, data[12345:32345]) {
+		t.Fatalf("Fetched data doesn't match")
+	}
+}
+
+func TestWebSeedFetchRateLimited(t *testing.T) {
+	dir := t.TempDir()
+	torr, data := newTestTorrent(t, dir, []int{200000})
+	server := httptest.NewServer(&rangeRecorder{dir: dir})
+	defer server.Close()
+
+	limit := NewRateLimiter(100 * 1024)
+	ws := &webSeed{url: server.URL + "/", torr: torr, limits: rateLimiters{limit}}
+	start := time.Now()
+	got, err := ws.fetch(context.Background(), 0, 150*1024)
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	if !bytes.Equal(got, data[:150*1024]) {
+		t.Fatalf("Fetched data doesn't match")
+	}
+	// The limiter starts empty, so 150 KiB at 100 KiB/s takes 1.5s.
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("Fetched in %v, faster than the limit", elapsed)
+	}
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	dir := t.TempDir()
+	torr, data := newTestTorrent(t, dir, []int{100000, 0, 123, 150000, 5})
+	server := httptest.NewServer(&rangeRecorder{dir: dir})
+	defer server.Close()
+
+	// Web seeds don't take the info hash.
+	d := NewDownloader(torr, make([]byte, 20))
+	d.AddWebSeed(server.URL + "/")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := d.Run(ctx); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+
+	var got []byte
+	for i := 0; i < torr.info.numPieces(); i++ {
+		got = append(got, d.Piece(i)...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Downloaded data doesn't match")
+	}
+}